@@ -0,0 +1,100 @@
+/*
+	此模块实现管理接口，所有管理接口都需要admin权限，见auth.go
+	/admin/pins    GET列出固定的文件，POST固定文件，DELETE取消固定，
+	               参数为ns(命名空间，默认命名空间为空)和file，文件名会加上命名空间的默认后缀
+	/upload        上传文件，见upload.go
+	/tus/          断点续传上传文件，见tus.go
+	/admin/files   DELETE删除源站中的文件，见delete.go
+	/admin/sign    生成带签名的下载链接，见signurl.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// 以json的形式返回结果
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	// 返回的链接中有&，不需要转义
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+// 根据管理接口的参数创建文件请求
+func adminFileRequest(w http.ResponseWriter, r *http.Request) (*fileRequest, bool) {
+	query := r.URL.Query()
+	ns, ok := namespaceByName(query.Get("ns"))
+	if !ok {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return nil, false
+	}
+	if query.Get("file") == "" {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return nil, false
+	}
+	name, ok := cleanFileName(query.Get("file") + ns.suffix)
+	if !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return nil, false
+	}
+	return newFileRequest(ns, name, nil), true
+}
+
+// 处理固定文件的管理接口
+func handlePins(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, adminScope) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, pins.list())
+
+	case http.MethodPost:
+		fr, ok := adminFileRequest(w, r)
+		if !ok {
+			return
+		}
+		err := pins.pin(r.Context(), fr)
+		if err != nil {
+			go myLog.doLog(errorType, "handlePins() pin "+fr.name+" err:"+err.Error())
+			if errors.Is(err, os.ErrNotExist) {
+				http.Error(w, "file not found", http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		go myLog.doLog(dailyType, "pin "+fr.key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		fr, ok := adminFileRequest(w, r)
+		if !ok {
+			return
+		}
+		pinned, err := pins.unpin(r.Context(), fr)
+		if err != nil {
+			go myLog.doLog(errorType, "handlePins() unpin "+fr.name+" err:"+err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !pinned {
+			http.Error(w, "file is not pinned", http.StatusNotFound)
+			return
+		}
+		go myLog.doLog(dailyType, "unpin "+fr.key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
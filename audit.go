@@ -0,0 +1,68 @@
+/*
+	此模块负责审计日志，修改源站的操作(例如删除文件)都会记录下来，
+	每条记录是一行json，追加到auditLog文件中，auditLog为空时写入错误日志
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 一条审计记录
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Remote    string    `json:"remote,omitempty"`    // 请求的来源地址
+	Principal string    `json:"principal,omitempty"` // 请求的身份，见auth.go
+	Namespace string    `json:"namespace,omitempty"`
+	File      string    `json:"file,omitempty"`
+	Soft      bool      `json:"soft,omitempty"`  // 是否移动到回收站
+	Roots     []string  `json:"roots,omitempty"` // 删除了文件的目录
+	Trash     string    `json:"trash,omitempty"` // 文件在回收站中的位置
+	Error     string    `json:"error,omitempty"`
+}
+
+// 审计日志的锁
+var auditMu = make(chan bool, 1)
+
+func init() {
+	auditMu <- true
+}
+
+// 写入一条审计记录
+func writeAudit(record auditRecord) {
+	record.Time = time.Now()
+	line, err := json.Marshal(record)
+	if err != nil {
+		go myLog.doLog(errorType, "writeAudit() err:"+err.Error())
+		return
+	}
+	if setting.AuditLog == "" {
+		go myLog.doLog(errorType, "audit:"+string(line))
+		return
+	}
+
+	<-auditMu
+	defer func() { auditMu <- true }()
+	err = os.MkdirAll(filepath.Dir(setting.AuditLog), 0755)
+	if err != nil {
+		go myLog.doLog(errorType, "writeAudit() err:"+err.Error())
+		return
+	}
+	f, err := os.OpenFile(setting.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		go myLog.doLog(errorType, "writeAudit() err:"+err.Error())
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		go myLog.doLog(errorType, "writeAudit() err:"+err.Error())
+	}
+}
@@ -0,0 +1,128 @@
+/*
+	此模块实现接口的认证和权限。
+	auth.enable为true时，请求需要带上以下任意一种凭证：
+	1. API key，请求头X-API-Key或者Authorization: Bearer <key>，
+	   配置文件中只保存key的sha256(auth.apiKeys[].hash)，可以用 echo -n key | sha256sum 计算
+	2. JWT，请求头Authorization: Bearer <token>，见jwt.go
+	每个凭证有若干个权限：
+	read     下载文件、列出目录
+	purge    清除缓存(/flush)
+	admin    所有管理接口，admin权限包括其他所有权限
+	没有凭证的请求拥有auth.anonymousScopes中的权限。
+	旧的adminToken(请求头X-Admin-Token)仍然可以使用，拥有admin权限。
+	auth.enable为false时只有管理接口需要adminToken，其他接口都不需要认证
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const (
+	readScope  = "read"
+	purgeScope = "purge"
+	adminScope = "admin"
+)
+
+// 请求的身份以及权限
+type principal struct {
+	name   string
+	scopes []string
+}
+
+// 是否拥有权限，admin权限包括其他所有权限
+func (p *principal) has(scope string) bool {
+	for _, s := range p.scopes {
+		if s == scope || s == adminScope {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据请求中的凭证确定身份，没有凭证时返回nil，凭证无效时返回错误
+func authenticate(r *http.Request) (*principal, error) {
+	if token := r.Header.Get("X-Admin-Token"); token != "" {
+		if setting.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(setting.AdminToken)) == 1 {
+			return &principal{name: "adminToken", scopes: []string{adminScope}}, nil
+		}
+		return nil, errInvalidToken
+	}
+
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		scheme, value, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return nil, nil
+		}
+		credential = strings.TrimSpace(value)
+	}
+	if !setting.Auth.Enable || credential == "" {
+		return nil, nil
+	}
+
+	// JWT由三段base64url组成，其他的都当作API key
+	if strings.Count(credential, ".") == 2 && setting.Auth.JWKS != "" {
+		name, scopes, err := verifyJWT(credential)
+		if err != nil {
+			return nil, err
+		}
+		return &principal{name: name, scopes: scopes}, nil
+	}
+
+	sum := sha256.Sum256([]byte(credential))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	for _, key := range setting.Auth.APIKeys {
+		if subtle.ConstantTimeCompare(hash, []byte(strings.ToLower(key.Hash))) == 1 {
+			return &principal{name: "apikey:" + key.Name, scopes: key.Scopes}, nil
+		}
+	}
+	return nil, errInvalidToken
+}
+
+// 检查请求是否拥有权限，没有时返回401或者403
+func requireScope(w http.ResponseWriter, r *http.Request, scope string) bool {
+	// 没有启用认证时只有管理接口需要adminToken
+	if !setting.Auth.Enable && scope != adminScope {
+		return true
+	}
+
+	p, err := authenticate(r)
+	if err != nil {
+		go myLog.doLog(errorType, "authenticate() "+r.RemoteAddr+" err:"+err.Error())
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "invalid credential", http.StatusUnauthorized)
+		return false
+	}
+	if p == nil {
+		p = &principal{name: "anonymous", scopes: setting.Auth.AnonymousScopes}
+		if !setting.Auth.Enable {
+			p.scopes = nil
+		}
+		if !p.has(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer scope="`+scope+`"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+	if !p.has(scope) {
+		http.Error(w, "insufficient scope", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// 返回请求的身份，用于审计日志
+func principalName(r *http.Request) string {
+	p, err := authenticate(r)
+	if err != nil || p == nil {
+		return "anonymous"
+	}
+	return p.name
+}
@@ -0,0 +1,189 @@
+/*
+	此模块实现下载的带宽限制，限制分为三级：
+	每个连接(每次响应)、每个客户端(同一个IP或者凭证的所有连接)以及整个进程的出口带宽，
+	每一级都是一个以字节为单位的令牌桶，桶的容量为一秒的流量。
+	文件按块写给客户端，每写一块之前从三个桶中取出相应的字节数，不够时等待，
+	从redis、本地磁盘缓存以及源站返回的文件都经过这里。
+	小于exemptSize的文件不等待，但仍然计入进程的出口带宽，大文件会给它们让出带宽。
+	写出的字节数同时计入统计数据，定时和命中率一起记录到日志中
+*/
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+)
+
+const maxShapeChunk = 32 * 1024 // 每次写出的最大字节数
+
+// 以字节为单位的令牌桶，令牌可以为负数，为负数时取令牌的请求需要等待令牌补回来
+type byteLimiter struct {
+	mu       chan bool
+	rate     float64 // 每秒补充的字节数，同时也是桶的容量
+	tokens   float64
+	last     time.Time
+	lastUsed time.Time
+}
+
+// 创建令牌桶，kbps为每秒的KB数，不大于0时不限制，返回nil
+func newByteLimiter(kbps int) *byteLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1024
+	bl := &byteLimiter{mu: make(chan bool, 1), rate: rate, tokens: rate, last: time.Now()}
+	bl.mu <- true
+	return bl
+}
+
+// 取出n个字节的令牌，返回需要等待的时间
+func (bl *byteLimiter) reserve(n int) time.Duration {
+	<-bl.mu
+	defer func() { bl.mu <- true }()
+
+	now := time.Now()
+	bl.tokens = math.Min(bl.rate, bl.tokens+now.Sub(bl.last).Seconds()*bl.rate)
+	bl.last = now
+	bl.lastUsed = now
+	bl.tokens -= float64(n)
+	if bl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bl.tokens / bl.rate * float64(time.Second))
+}
+
+// 取出n个字节的令牌并等待，请求被取消时返回错误
+func (bl *byteLimiter) wait(ctx context.Context, n int) error {
+	if bl == nil {
+		return nil
+	}
+	delay := bl.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 每个客户端的令牌桶
+type clientLimiters struct {
+	mu        chan bool
+	limiters  map[string]*byteLimiter
+	lastSweep time.Time
+}
+
+var globalBandwidth *byteLimiter // 进程的出口带宽
+var clientBandwidth *clientLimiters
+
+// 根据配置创建进程和客户端的令牌桶
+func initBandwidth() {
+	globalBandwidth = newByteLimiter(setting.Bandwidth.Global)
+	clientBandwidth = &clientLimiters{mu: make(chan bool, 1), limiters: make(map[string]*byteLimiter), lastSweep: time.Now()}
+	clientBandwidth.mu <- true
+}
+
+// 返回客户端的令牌桶，顺便删除一分钟没有使用的令牌桶
+func (cl *clientLimiters) get(client string) *byteLimiter {
+	if setting.Bandwidth.PerClient <= 0 {
+		return nil
+	}
+	<-cl.mu
+	defer func() { cl.mu <- true }()
+
+	now := time.Now()
+	if now.Sub(cl.lastSweep) > time.Minute {
+		for id, bl := range cl.limiters {
+			<-bl.mu
+			idle := now.Sub(bl.lastUsed) > time.Minute
+			bl.mu <- true
+			if idle {
+				delete(cl.limiters, id)
+			}
+		}
+		cl.lastSweep = now
+	}
+	bl, ok := cl.limiters[client]
+	if !ok {
+		bl = newByteLimiter(setting.Bandwidth.PerClient)
+		bl.lastUsed = now
+		cl.limiters[client] = bl
+	}
+	return bl
+}
+
+// 限制带宽的ResponseWriter，同时统计写出的字节数
+type shapedWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	exempt bool
+	chunk  int
+	conn   *byteLimiter
+	client *byteLimiter
+}
+
+// 给一次响应加上带宽限制，size为要返回的文件大小
+func shapeResponse(w http.ResponseWriter, r *http.Request, size int) http.ResponseWriter {
+	bw := setting.Bandwidth
+	sw := &shapedWriter{ResponseWriter: w, ctx: r.Context(), chunk: maxShapeChunk}
+	if bw.ExemptSize > 0 && size < bw.ExemptSize*1024 {
+		sw.exempt = true
+		return sw
+	}
+	sw.conn = newByteLimiter(bw.PerConnection)
+	if bw.PerClient > 0 {
+		sw.client = clientBandwidth.get(clientID(r))
+	}
+
+	// 每块不超过最小限速的十分之一，让流量尽量平滑
+	for _, kbps := range []int{bw.PerConnection, bw.PerClient, bw.Global} {
+		if kbps > 0 && kbps*1024/10 < sw.chunk {
+			sw.chunk = kbps * 1024 / 10
+		}
+	}
+	if sw.chunk < 1024 {
+		sw.chunk = 1024
+	}
+	return sw
+}
+
+func (sw *shapedWriter) Write(p []byte) (int, error) {
+	if sw.exempt {
+		// 不等待，但是占用进程的出口带宽
+		if globalBandwidth != nil {
+			globalBandwidth.reserve(len(p))
+		}
+		n, err := sw.ResponseWriter.Write(p)
+		c.sentAdd(n)
+		return n, err
+	}
+
+	written := 0
+	for written < len(p) {
+		end := written + sw.chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		size := end - written
+		for _, bl := range []*byteLimiter{sw.conn, sw.client, globalBandwidth} {
+			if err := bl.wait(sw.ctx, size); err != nil {
+				return written, err
+			}
+		}
+		n, err := sw.ResponseWriter.Write(p[written:end])
+		written += n
+		c.sentAdd(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,129 @@
+/*
+	此模块实现redis的熔断器。
+	redis变慢或者宕机时，每一次请求都要等待PoolTimeout才会从硬盘加载，
+	熔断器以go-redis的hook的形式挂在客户端上，统计所有redis操作的结果：
+	连续失败(出错或者超时)达到阈值后熔断器打开，此时getFile不再访问redis，直接从硬盘加载；
+	熔断器打开后会在后台定时ping redis，ping通之后熔断器关闭，恢复正常的缓存逻辑。
+	每次状态变化都会记录到错误日志中
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var errBreakerOpen = errors.New("redis circuit breaker is open")
+
+// 熔断器
+type circuitBreaker struct {
+	name     string
+	client   redis.UniversalClient
+	open     atomic.Bool  // 熔断器是否打开
+	failures atomic.Int32 // 连续失败的次数
+}
+
+// 标记探测请求的context的key，探测请求不受熔断器的限制
+type probeKey struct{}
+
+var rdbBreaker *circuitBreaker // 单机、哨兵或者集群客户端的熔断器
+
+// 创建熔断器，并以hook的形式挂到客户端上
+func newCircuitBreaker(name string, client redis.UniversalClient) *circuitBreaker {
+	cb := new(circuitBreaker)
+	cb.name = name
+	cb.client = client
+	client.AddHook(cb)
+	return cb
+}
+
+// 熔断器是否打开
+func (cb *circuitBreaker) isOpen() bool {
+	return cb.open.Load()
+}
+
+// 建立连接的错误会体现在命令的结果中，这里不需要统计
+func (cb *circuitBreaker) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (cb *circuitBreaker) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cb.isOpen() && ctx.Value(probeKey{}) == nil {
+			cmd.SetErr(errBreakerOpen)
+			return errBreakerOpen
+		}
+		err := next(ctx, cmd)
+		cb.record(ctx, err)
+		return err
+	}
+}
+
+func (cb *circuitBreaker) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if cb.isOpen() && ctx.Value(probeKey{}) == nil {
+			for _, cmd := range cmds {
+				cmd.SetErr(errBreakerOpen)
+			}
+			return errBreakerOpen
+		}
+		err := next(ctx, cmds)
+		cb.record(ctx, err)
+		return err
+	}
+}
+
+// 记录一次redis操作的结果
+// redis返回的错误(包括redis.Nil)说明redis是正常工作的，不算作失败，
+// 客户端断开连接导致的取消也不是redis的问题
+func (cb *circuitBreaker) record(ctx context.Context, err error) {
+	var redisErr redis.Error
+	if err == nil || errors.As(err, &redisErr) || errors.Is(err, context.Canceled) || ctx.Value(probeKey{}) != nil {
+		cb.failures.Store(0)
+		return
+	}
+
+	threshold := int32(setting.BreakerThreshold)
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cb.failures.Add(1) < threshold {
+		return
+	}
+
+	// 连续失败达到阈值，打开熔断器并启动探测
+	if cb.open.CompareAndSwap(false, true) {
+		go myLog.doLog(errorType, "redis "+cb.name+" circuit breaker open:"+err.Error())
+		go cb.probe()
+	}
+}
+
+// 在后台定时ping redis，ping通之后关闭熔断器
+func (cb *circuitBreaker) probe() {
+
+	interval := time.Duration(setting.BreakerProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeKey{}, true), interval)
+		err := cb.client.Ping(ctx).Err()
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		cb.failures.Store(0)
+		cb.open.Store(false)
+		myLog.doLog(errorType, "redis "+cb.name+" circuit breaker closed")
+		return
+	}
+}
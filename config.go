@@ -20,6 +20,189 @@ type Serverconfig struct {
 	LoggerPath string `json:"loggerPath"` // 日志文件的路径
 	FlushTime  int    `json:"flushtime"`  // 刷新一次日志的时间，单位为秒
 	CalTime    int    `json:"caltime"`    // 输出一次统计数据的时间，单位为秒
+
+	RequestTimeout  int `json:"requestTimeout"`  // 一个下载请求的截止时间，单位为毫秒，0为不限制
+	DiskReadTimeout int `json:"diskReadTimeout"` // 从硬盘读取一个文件的截止时间，单位为毫秒，0为不限制
+
+	Roots             []string `json:"roots"`             // 存放文件副本的多个目录，按顺序尝试，为空时只使用prefix
+	RootTimeout       int      `json:"rootTimeout"`       // 从一个目录读取文件的超时时间，超时后尝试下一个目录，单位为毫秒，0为不限制
+	RootCheckInterval int      `json:"rootCheckInterval"` // 检查目录是否可用的间隔，单位为秒
+
+	DiskCache  DiskCacheConfig   `json:"diskCache"`  // 本地磁盘缓存
+	Origin     OriginConfig      `json:"origin"`     // 源站
+	Namespaces []NamespaceConfig `json:"namespaces"` // 虚拟命名空间
+	Rules      []CacheRule       `json:"rules"`      // 按顺序匹配的缓存规则
+
+	AdminToken string `json:"adminToken"` // 管理接口的令牌，为空时管理接口不可用
+	PinFile    string `json:"pinFile"`    // 保存固定文件的路径，为空时重启后不恢复
+
+	NegativeTTL     int `json:"negativeTTL"`     // 记住文件不存在的时间，单位为秒，0为不记住
+	MissLogInterval int `json:"missLogInterval"` // 汇总记录不存在的文件的间隔，单位为秒，默认为60
+
+	StaleTTL int `json:"staleTTL"` // 文件过期之后还可以返回的时间，单位为秒，0为不返回过期的文件
+
+	WatchOrigin        bool `json:"watchOrigin"`        // 用inotify监听源站目录，只支持linux
+	RevalidateInterval int  `json:"revalidateInterval"` // 与源站文件比较的间隔，单位为秒，0为不比较
+
+	Upload UploadConfig `json:"upload"` // 上传文件的限制
+	Tus    TusConfig    `json:"tus"`    // 断点续传上传
+
+	Trash    TrashConfig `json:"trash"`    // 删除文件的回收站
+	AuditLog string      `json:"auditLog"` // 审计日志的路径，为空时写入错误日志
+
+	ListCacheTTL int `json:"listCacheTTL"` // 目录列表的缓存时间，单位为秒，0为不缓存
+
+	SignedURL SignedURLConfig `json:"signedURL"` // 带签名的下载链接
+	Auth      AuthConfig      `json:"auth"`      // 接口的认证
+
+	RateLimit RateLimitConfig `json:"rateLimit"` // 按客户端限流
+	Bandwidth BandwidthConfig `json:"bandwidth"` // 下载的带宽限制
+
+	OriginConcurrency OriginConcurrencyConfig `json:"originConcurrency"` // 同时读取源站的限制
+}
+
+// 同时读取源站的限制
+type OriginConcurrencyConfig struct {
+	MaxConcurrent int `json:"maxConcurrent"` // 同时读取源站的最大数量，0为不限制
+	QueueSize     int `json:"queueSize"`     // 最多排队的请求数量，超过时直接返回503
+	QueueTimeout  int `json:"queueTimeout"`  // 排队的最长时间，单位为毫秒
+	RetryAfter    int `json:"retryAfter"`    // 返回503时的Retry-After，单位为秒，默认为1
+}
+
+// 带宽限制的配置，单位都是KB/s，0为不限制
+type BandwidthConfig struct {
+	PerConnection int `json:"perConnection"` // 每个连接的带宽
+	PerClient     int `json:"perClient"`     // 每个客户端(IP或者凭证)的带宽
+	Global        int `json:"global"`        // 整个进程的出口带宽
+	ExemptSize    int `json:"exemptSize"`    // 小于这个大小(KB)的文件不限速，0为全部限速
+}
+
+// 限流的配置
+type RateLimitConfig struct {
+	Enable bool             `json:"enable"` // 是否启用限流
+	Routes []RateLimitRoute `json:"routes"` // 每个路由的限流，没有配置的路由不限流
+}
+
+// 一个路由的限流
+type RateLimitRoute struct {
+	Path  string  `json:"path"`  // 路由，例如/download，包括/download/下的请求
+	Rate  float64 `json:"rate"`  // 每秒补充的令牌数，即长期的平均请求速率
+	Burst int     `json:"burst"` // 桶的容量，即允许的突发请求数
+}
+
+// 认证的配置
+type AuthConfig struct {
+	Enable          bool     `json:"enable"`          // 是否启用认证
+	APIKeys         []APIKey `json:"apiKeys"`         // 静态的API key
+	JWKS            string   `json:"jwks"`            // 验证JWT的JWKS文件，为空时不接受JWT
+	Issuer          string   `json:"issuer"`          // JWT的iss，为空时不检查
+	Audience        string   `json:"audience"`        // JWT的aud，为空时不检查
+	AnonymousScopes []string `json:"anonymousScopes"` // 没有凭证的请求拥有的权限
+}
+
+// 静态的API key
+type APIKey struct {
+	Name   string   `json:"name"`   // 名字，记录在审计日志中
+	Hash   string   `json:"hash"`   // key的sha256，十六进制
+	Scopes []string `json:"scopes"` // 权限，read、purge或者admin
+}
+
+// 签名链接的配置
+type SignedURLConfig struct {
+	Require    bool      `json:"require"`    // 下载是否必须使用签名链接
+	Keys       []SignKey `json:"keys"`       // 签名的密钥，第一个用来生成链接
+	DefaultTTL int       `json:"defaultTTL"` // 生成的链接默认的有效时间，单位为秒
+	BaseURL    string    `json:"baseURL"`    // 生成的链接的前缀，例如https://cdn.example.com
+}
+
+// 签名的密钥
+type SignKey struct {
+	ID         string `json:"id"`         // 密钥的id，链接中的kid参数
+	Secret     string `json:"secret"`     // 密钥
+	SecretEnv  string `json:"secretEnv"`  // 存放密钥的环境变量名，优先级高于secret
+	SecretFile string `json:"secretFile"` // 存放密钥的文件，优先级低于secretEnv，高于secret
+}
+
+// 回收站的配置
+type TrashConfig struct {
+	Dir       string `json:"dir"`       // 回收站的目录，为空时直接删除文件
+	Retention int    `json:"retention"` // 文件在回收站中保留的时间，单位为小时
+}
+
+// 断点续传上传的配置
+type TusConfig struct {
+	Dir    string `json:"dir"`    // 保存没有完成的数据的目录
+	Expire int    `json:"expire"` // 上传没有继续时的过期时间，单位为小时，默认为24
+}
+
+// 上传文件的配置
+type UploadConfig struct {
+	MaxSize      int      `json:"maxSize"`      // 上传文件的大小上限，单位为MB，0为不限制
+	AllowedTypes []string `json:"allowedTypes"` // 允许上传的类型，支持image/*这样的通配，为空时都允许
+}
+
+// 缓存规则，匹配条件都为空的规则会被忽略，策略为0时沿用命名空间的值
+type CacheRule struct {
+	Path        string `json:"path"`        // 文件名的glob，例如videos/*.mp4
+	Suffix      string `json:"suffix"`      // 文件后缀，例如m3u8
+	MimeType    string `json:"mimeType"`    // MineType中的类型，支持font/*这样的通配
+	Cache       string `json:"cache"`       // never为从不缓存，always为第一次访问就缓存
+	LoadCount   int    `json:"loadCount"`   // 需要缓存的访问次数
+	ExtendCount int    `json:"extendCount"` // 需要延长存活时间的次数
+	TTL         int    `json:"ttl"`         // 文件第一次缓存的存活时间，单位为分钟
+	HotTTL      int    `json:"hotttl"`      // 热点数据的存活时间，单位为分钟
+	MaxSize     int    `json:"maxSize"`     // 可以缓存的最大文件大小，单位为KB
+}
+
+// 命名空间的配置，策略为0时沿用RDBConfig中的值
+type NamespaceConfig struct {
+	Name        string        `json:"name"`        // 命名空间的名字，请求路径为/download/{name}
+	Hosts       []string      `json:"hosts"`       // 使用这个命名空间的Host
+	Prefix      string        `json:"prefix"`      // 源站目录
+	Roots       []string      `json:"roots"`       // 存放文件副本的多个目录，配置后忽略prefix
+	Origin      *OriginConfig `json:"origin"`      // 源站，为空时使用本地文件系统
+	Suffix      string        `json:"suffix"`      // 默认的文件后缀
+	KeyPrefix   string        `json:"keyPrefix"`   // 缓存key的前缀，为空时为"名字/"，不能以"/"开头
+	LoadCount   int           `json:"loadCount"`   // 需要缓存的访问次数
+	ExtendCount int           `json:"extendCount"` // 需要延长存活时间的次数
+	TTL         int           `json:"ttl"`         // 文件第一次缓存的存活时间，单位为分钟
+	HotTTL      int           `json:"hotttl"`      // 热点数据的存活时间，单位为分钟
+}
+
+// 源站的配置
+type OriginConfig struct {
+	Type           string   `json:"type"`           // 源站类型，file或者http，为空时为file
+	URL            string   `json:"url"`            // http源站的地址，文件名拼接在后面
+	ForwardHeaders []string `json:"forwardHeaders"` // 需要转发给http源站的请求头
+	Timeout        int      `json:"timeout"`        // 请求http或者s3源站的超时时间，单位为毫秒，0为不限制
+	S3             S3Config `json:"s3"`             // s3源站的配置
+}
+
+// S3兼容的对象存储源站的配置
+type S3Config struct {
+	Endpoint         string `json:"endpoint"`         // 对象存储的地址，例如http://127.0.0.1:9000
+	Region           string `json:"region"`           // 区域，为空时为us-east-1
+	Bucket           string `json:"bucket"`           // 桶的名字
+	KeyPrefix        string `json:"keyPrefix"`        // 对象key的前缀，文件名拼接在后面
+	AccessKey        string `json:"accessKey"`        // access key
+	SecretKey        string `json:"secretKey"`        // secret key
+	AccessKeyEnv     string `json:"accessKeyEnv"`     // 存放access key的环境变量名，优先级高于accessKey
+	SecretKeyEnv     string `json:"secretKeyEnv"`     // 存放secret key的环境变量名，优先级高于secretKey
+	SessionTokenEnv  string `json:"sessionTokenEnv"`  // 存放临时凭证session token的环境变量名
+	AccessKeyFile    string `json:"accessKeyFile"`    // 存放access key的文件，优先级低于accessKeyEnv，高于accessKey
+	SecretKeyFile    string `json:"secretKeyFile"`    // 存放secret key的文件，优先级低于secretKeyEnv，高于secretKey
+	SessionTokenFile string `json:"sessionTokenFile"` // 存放session token的文件，优先级低于sessionTokenEnv
+	VirtualHost      bool   `json:"virtualHost"`      // 使用bucket.endpoint形式的地址，默认使用endpoint/bucket
+}
+
+// 本地磁盘缓存的配置
+type DiskCacheConfig struct {
+	Enable      bool   `json:"enable"`      // 是否启用
+	Dir         string `json:"dir"`         // 缓存目录，应该在本地SSD上
+	MaxSize     int    `json:"maxSize"`     // 容量上限，单位为MB
+	MaxItemSize int    `json:"maxItemSize"` // 单个文件的大小上限，单位为MB，0为不限制
+	AdmitCount  int    `json:"admitCount"`  // 文件从源站读取多少次之后写入本地磁盘缓存
+	Demote      bool   `json:"demote"`      // redis中的文件过期时是否降级写入本地磁盘缓存
 }
 
 // redis数据库配置文件仓库
@@ -37,6 +220,51 @@ type RDBConfig struct {
 	TTL          int    `json:"ttl"`          // 文件第一次缓存的存活时间，单位为分钟
 	HotTTL       int    `json:"hotttl"`       // 热点数据的存活时间，单位为分钟
 
+	Store string `json:"store"` // 缓存仓库，redis或者memory，memory时不需要redis
+
+	Mode             string   `json:"mode"`             // 部署方式，standalone/sentinel/cluster，为空时根据地址推断
+	MasterName       string   `json:"masterName"`       // 哨兵模式下主节点的名字
+	SentinelAddrs    []string `json:"sentinelAddrs"`    // 哨兵节点的地址列表
+	SentinelPassword string   `json:"sentinelPassword"` // 哨兵节点的密码
+
+	SentinelPasswordFile string `json:"sentinelPasswordFile"` // 存放哨兵密码的文件，优先级高于sentinelPassword
+	SentinelPasswordEnv  string `json:"sentinelPasswordEnv"`  // 存放哨兵密码的环境变量名，优先级最高
+
+	ClusterAddrs []string `json:"clusterAddrs"` // 集群模式下的种子节点地址列表
+
+	Shards             []ShardConfig `json:"shards"`             // 在客户端分片的多个独立redis实例，配置后忽略上面的地址
+	ShardCheckInterval int           `json:"shardCheckInterval"` // 检查分片是否可用的间隔，单位为秒
+
+	BreakerThreshold     int `json:"breakerThreshold"`     // 连续失败多少次之后打开熔断器
+	BreakerProbeInterval int `json:"breakerProbeInterval"` // 熔断器打开后探测redis的间隔，单位为秒
+
+	ReadTimeout  int `json:"readTimeout"`  // 单个redis读操作的截止时间，单位为毫秒，0为不限制，不包括读取文件的数据
+	WriteTimeout int `json:"writeTimeout"` // 单个redis写操作的截止时间，单位为毫秒，0为不限制，不包括写入文件的数据
+
+	UserName     string    `json:"username"`     // redis ACL用户名，为空时使用default用户
+	PassWordFile string    `json:"passwordFile"` // 存放redis密码的文件，优先级高于password
+	PassWordEnv  string    `json:"passwordEnv"`  // 存放redis密码的环境变量名，优先级最高
+	TLS          TLSConfig `json:"tls"`          // 连接redis使用的TLS配置
+}
+
+// TLS配置
+type TLSConfig struct {
+	Enable             bool   `json:"enable"`             // 是否启用TLS
+	CAFile             string `json:"caFile"`             // 验证服务端证书的CA证书，为空时使用系统的CA
+	CertFile           string `json:"certFile"`           // 客户端证书
+	KeyFile            string `json:"keyFile"`            // 客户端证书的私钥
+	ServerName         string `json:"serverName"`         // 验证服务端证书时使用的域名，为空时使用连接地址
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // 不验证服务端证书，只应该在测试时使用
+}
+
+// 单个redis分片的配置
+type ShardConfig struct {
+	Name         string `json:"name"`         // 分片的名字，用于哈希，修改名字会让分片上的key移动
+	Addr         string `json:"addr"`         // 分片的地址，例如10.0.0.1:6379
+	PassWord     string `json:"password"`     // 分片的密码
+	PassWordFile string `json:"passwordFile"` // 存放分片密码的文件，优先级高于password
+	PassWordEnv  string `json:"passwordEnv"`  // 存放分片密码的环境变量名，优先级最高
+	DB           int    `json:"db"`           // 启用的数据库(桶)
 }
 
 type Settings struct {
@@ -0,0 +1,197 @@
+/*
+	此模块实现删除源站文件的管理接口。
+	DELETE /admin/files?ns=&file= 删除命名空间源站目录中的文件(只支持本地文件系统源站)：
+	1. 配置了多个目录时每个目录中的副本都会被删除
+	2. trash.dir不为空时默认是软删除，文件移动到回收站，超过trash.retention小时后才真正删除；
+	   参数permanent=true时直接删除
+	3. 删除缓存中的文件(包括访问次数)、本地磁盘缓存，固定的文件会被取消固定
+	每次删除都会记录到审计日志中
+	回收站的结构为 trash.dir/删除时间(unix纳秒)/命名空间/目录序号/文件名
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const defaultNamespaceDir = "_default" // 回收站中默认命名空间的目录名
+
+// 处理删除文件的请求
+func handleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, adminScope) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	ns, ok := namespaceByName(query.Get("ns"))
+	if !ok {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return
+	}
+	lo, ok := ns.origin.(*localOrigin)
+	if !ok {
+		http.Error(w, "origin of this namespace is not writable", http.StatusBadRequest)
+		return
+	}
+	name, ok := cleanUploadName(query.Get("file") + ns.suffix)
+	if !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	soft := setting.Trash.Dir != "" && query.Get("permanent") != "true"
+
+	record := auditRecord{
+		Action:    "delete",
+		Remote:    r.RemoteAddr,
+		Principal: principalName(r),
+		Namespace: ns.name,
+		File:      name,
+		Soft:      soft,
+	}
+	removed, trash, err := deleteOriginFile(lo, ns, name, soft)
+	record.Roots = removed
+	record.Trash = trash
+	if err != nil {
+		record.Error = err.Error()
+	}
+	writeAudit(record)
+
+	if err != nil {
+		go myLog.doLog(errorType, "handleDeleteFile() "+name+" err:"+err.Error())
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "file not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "failed to delete file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// 清除缓存中的文件以及本地的缓存
+	fr := newFileRequest(ns, name, nil)
+	if pins.has(fr.key) {
+		_, err = pins.unpin(r.Context(), fr)
+		if err != nil {
+			go myLog.doLog(errorType, "handleDeleteFile() unpin err:"+err.Error())
+		}
+	}
+	if store.Available(fr.key) == nil {
+		err = store.Del(r.Context(), fr.key)
+		if err != nil {
+			go myLog.doLog(errorType, "handleDeleteFile() purge err:"+err.Error())
+		}
+	}
+	if diskCache != nil {
+		diskCache.remove(fr.key)
+	}
+	go myLog.doLog(dailyType, "delete "+ns.keyPrefix+name)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": ns.name,
+		"file":      name,
+		"roots":     removed,
+		"trash":     trash,
+	})
+}
+
+// 删除每个目录中的文件，软删除时移动到回收站，返回删除了文件的目录以及回收站中的位置
+func deleteOriginFile(lo *localOrigin, ns *namespace, name string, soft bool) ([]string, string, error) {
+	nsDir := ns.name
+	if nsDir == "" {
+		nsDir = defaultNamespaceDir
+	}
+	trash := ""
+	if soft {
+		trash = filepath.Join(setting.Trash.Dir, strconv.FormatInt(time.Now().UnixNano(), 10), nsDir)
+	}
+
+	var removed []string
+	for i, root := range lo.roots {
+		src := filepath.Join(root.path, filepath.FromSlash(name))
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		var err error
+		if soft {
+			err = moveFile(src, filepath.Join(trash, strconv.Itoa(i), filepath.FromSlash(name)))
+		} else {
+			err = os.Remove(src)
+		}
+		if err != nil {
+			return removed, trash, err
+		}
+		removed = append(removed, root.path)
+	}
+	if len(removed) == 0 {
+		return nil, "", os.ErrNotExist
+	}
+	return removed, trash, nil
+}
+
+// 移动文件，回收站与源站不在同一个文件系统时先复制再删除
+func moveFile(src string, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// 定时清空回收站中超过保留时间的文件
+func cleanTrash(interval time.Duration) {
+	retention := time.Duration(setting.Trash.Retention) * time.Hour
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		entries, err := os.ReadDir(setting.Trash.Dir)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				myLog.doLog(errorType, "cleanTrash() err:"+err.Error())
+			}
+			continue
+		}
+		for _, entry := range entries {
+			deletedAt, err := strconv.ParseInt(entry.Name(), 10, 64)
+			if err != nil || time.Since(time.Unix(0, deletedAt)) < retention {
+				continue
+			}
+			err = os.RemoveAll(filepath.Join(setting.Trash.Dir, entry.Name()))
+			if err != nil {
+				myLog.doLog(errorType, "cleanTrash() err:"+err.Error())
+				continue
+			}
+			writeAudit(auditRecord{Action: "purge-trash", Trash: filepath.Join(setting.Trash.Dir, entry.Name())})
+		}
+	}
+}
@@ -0,0 +1,392 @@
+/*
+	此模块实现位于redis与源站之间的本地磁盘缓存。
+	源站(Prefix)可能是NFS这样读取很慢的挂载点，而redis的内存又只够放最热的文件，
+	所以可以在本地SSD上再缓存一层：
+	1. 本地磁盘缓存有自己的容量上限，超过上限时按LRU淘汰
+	2. 文件从源站读取的次数达到admitCount后才会写入本地磁盘缓存，与redis的loadCount无关
+	3. redis中的文件过期时不会直接丢弃，而是降级写入本地磁盘缓存
+	4. 文件写入时记录过期时间(命名空间的ttl，源站的max-age更短时使用max-age)，过期的文件视为不存在
+	本地磁盘缓存中的文件名为key的sha1，旁边的.meta文件以json的形式保存key以及源站返回的元数据
+	(Content-Type、ETag、max-age、修改时间)，从本地磁盘缓存返回或者再写入redis时元数据不会丢失。
+	删除文件时递增序号，删除之前开始的读取在之后才写入的旧文件会被丢弃。
+	重启后根据文件的修改时间恢复LRU的顺序
+*/
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tierMetaSuffix = ".meta" // 元数据文件的后缀
+
+// 本地磁盘缓存中的一个文件
+type tierItem struct {
+	name string // 文件在本地磁盘缓存中的名字
+	size int64
+}
+
+// 与文件一起保存的元数据
+type tierMeta struct {
+	Key          string `json:"key"`
+	ContentType  string `json:"type"`
+	ETag         string `json:"etag"`
+	MaxAge       int64  `json:"maxage"`  // 单位为秒
+	LastModified int64  `json:"mtime"`   // 源站文件的修改时间，UnixNano
+	Expires      int64  `json:"expires"` // 过期时间，Unix秒
+}
+
+// 根据缓存策略的ttl以及max-age计算过期时间
+func tierExpires(ttl time.Duration, maxAge int64) int64 {
+	if maxAge > 0 && time.Duration(maxAge)*time.Second < ttl {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	return time.Now().Add(ttl).Unix()
+}
+
+// 是否已经过期，旧版本写入的文件没有过期时间，无法判断是否过期，同样视为过期
+func (meta tierMeta) expired() bool {
+	return time.Now().Unix() >= meta.Expires
+}
+
+// 从文件请求中取出元数据
+func metaFromRequest(fr *fileRequest) tierMeta {
+	meta := tierMeta{Key: fr.key, ContentType: fr.contentType, ETag: fr.etag, MaxAge: int64(fr.maxAge / time.Second)}
+	meta.Expires = tierExpires(fr.policy.TTL, meta.MaxAge)
+	if !fr.lastModified.IsZero() {
+		meta.LastModified = fr.lastModified.UnixNano()
+	}
+	return meta
+}
+
+// 从缓存的hash中取出元数据，过期时间使用文件所在命名空间的ttl
+func metaFromFields(key string, fields map[string]string) tierMeta {
+	meta := tierMeta{Key: key, ContentType: fields["type"], ETag: fields["etag"]}
+	meta.MaxAge, _ = strconv.ParseInt(fields["maxage"], 10, 64)
+	meta.LastModified, _ = strconv.ParseInt(fields["mtime"], 10, 64)
+	ns, name := namespaceForKey(key)
+	meta.Expires = tierExpires(applyRules(ns.policy, name).TTL, meta.MaxAge)
+	return meta
+}
+
+// 把元数据填回文件请求
+func (meta tierMeta) apply(fr *fileRequest) {
+	fr.contentType = meta.ContentType
+	fr.etag = meta.ETag
+	fr.maxAge = time.Duration(meta.MaxAge) * time.Second
+	if meta.LastModified != 0 {
+		fr.lastModified = time.Unix(0, meta.LastModified)
+	}
+}
+
+// 本地磁盘缓存
+type diskTier struct {
+	dir      string
+	maxSize  int64 // 容量上限，单位为字节
+	maxItem  int64 // 单个文件的大小上限，单位为字节
+	admit    int   // 从源站读取多少次之后写入
+	mu       chan bool
+	size     int64                    // 当前占用的空间
+	lru      *list.List               // 最近使用的在前面
+	items    map[string]*list.Element // 文件名到LRU节点的映射
+	accesses map[string]int           // 还没写入的文件从源站读取的次数
+	seq      uint64                   // 每次删除文件时递增
+	removed  map[string]uint64        // 文件名到最后一次删除时的序号
+	floor    uint64                   // removed被清空时的序号，之前开始的写入都丢弃
+}
+
+var diskCache *diskTier // 全局的本地磁盘缓存，没有启用时为nil
+
+// 根据配置创建本地磁盘缓存，并从目录中恢复已经缓存的文件
+func newDiskTier() (*diskTier, error) {
+
+	dt := new(diskTier)
+	dt.dir = setting.DiskCache.Dir
+	dt.maxSize = int64(setting.DiskCache.MaxSize) << 20
+	dt.maxItem = int64(setting.DiskCache.MaxItemSize) << 20
+	dt.admit = setting.DiskCache.AdmitCount
+	dt.lru = list.New()
+	dt.items = make(map[string]*list.Element)
+	dt.accesses = make(map[string]int)
+	dt.removed = make(map[string]uint64)
+	dt.mu = make(chan bool, 1)
+	dt.mu <- true
+
+	err := os.MkdirAll(dt.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// 恢复已经缓存的文件，修改时间越新越靠近LRU的前面
+	entries, err := os.ReadDir(dt.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// 元数据文件以及没有写完的临时文件不计入
+		if strings.HasSuffix(entry.Name(), tierMetaSuffix) || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		dt.items[info.Name()] = dt.lru.PushBack(&tierItem{name: info.Name(), size: info.Size()})
+		dt.size += info.Size()
+	}
+	dt.evict()
+
+	return dt, nil
+}
+
+// 返回key在本地磁盘缓存中的文件名
+func tierName(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// 从本地磁盘缓存中读取文件以及元数据，过期或者没有元数据的文件视为不存在
+func (dt *diskTier) get(key string) ([]byte, tierMeta, bool) {
+	name := tierName(key)
+
+	<-dt.mu
+	elem, ok := dt.items[name]
+	if ok {
+		dt.lru.MoveToFront(elem)
+	}
+	dt.mu <- true
+	if !ok {
+		return nil, tierMeta{}, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(dt.dir, name))
+	if err != nil {
+		// 文件被外部删除了，从索引中去掉
+		go myLog.doLog(errorType, "diskTier.get() err:"+err.Error())
+		dt.remove(key)
+		return nil, tierMeta{}, false
+	}
+	meta, err := dt.readMeta(name)
+	if err != nil || meta.expired() {
+		dt.remove(key)
+		return nil, tierMeta{}, false
+	}
+	meta.Key = key
+	return data, meta, true
+}
+
+// 读取文件的元数据
+func (dt *diskTier) readMeta(name string) (tierMeta, error) {
+	var meta tierMeta
+	content, err := os.ReadFile(filepath.Join(dt.dir, name+tierMetaSuffix))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(content, &meta)
+	return meta, err
+}
+
+// 写入临时文件，返回临时文件的路径，持有锁时再重命名，避免读到写了一半的文件
+func (dt *diskTier) writeTemp(data []byte) (string, error) {
+	tmp, err := os.CreateTemp(dt.dir, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// 返回当前的序号，在开始读取要写入的文件之前获取，传给put
+func (dt *diskTier) generation() uint64 {
+	<-dt.mu
+	defer func() { dt.mu <- true }()
+	return dt.seq
+}
+
+// 记录一次从源站的读取，返回这个文件是否应该写入本地磁盘缓存
+func (dt *diskTier) shouldAdmit(key string, size int) bool {
+	if dt.maxItem > 0 && int64(size) > dt.maxItem {
+		return false
+	}
+
+	<-dt.mu
+	defer func() { dt.mu <- true }()
+
+	// 计数表只是为了判断准入，太大时直接清空，避免占用过多内存
+	if len(dt.accesses) > 100000 {
+		dt.accesses = make(map[string]int)
+	}
+	dt.accesses[key]++
+	if dt.accesses[key] < dt.admit {
+		return false
+	}
+	delete(dt.accesses, key)
+	return true
+}
+
+// 将文件以及元数据写入本地磁盘缓存，gen为开始读取文件时的序号，
+// 之后文件被删除过时说明读到的可能是旧文件，直接丢弃
+func (dt *diskTier) put(key string, data []byte, meta tierMeta, gen uint64) {
+	size := int64(len(data))
+	if dt.maxItem > 0 && size > dt.maxItem || size > dt.maxSize {
+		return
+	}
+	name := tierName(key)
+
+	meta.Key = key
+	content, err := json.Marshal(meta)
+	if err != nil {
+		go myLog.doLog(errorType, "diskTier.put() err:"+err.Error())
+		return
+	}
+	metaTmp, err := dt.writeTemp(content)
+	if err != nil {
+		go myLog.doLog(errorType, "diskTier.put() err:"+err.Error())
+		return
+	}
+	dataTmp, err := dt.writeTemp(data)
+	if err != nil {
+		os.Remove(metaTmp)
+		go myLog.doLog(errorType, "diskTier.put() err:"+err.Error())
+		return
+	}
+
+	<-dt.mu
+	defer func() { dt.mu <- true }()
+	if gen < dt.floor || gen < dt.removed[name] {
+		os.Remove(metaTmp)
+		os.Remove(dataTmp)
+		return
+	}
+	// 元数据先重命名，读到文件时元数据一定已经写好
+	err = os.Rename(metaTmp, filepath.Join(dt.dir, name+tierMetaSuffix))
+	if err == nil {
+		err = os.Rename(dataTmp, filepath.Join(dt.dir, name))
+	}
+	if err != nil {
+		os.Remove(metaTmp)
+		os.Remove(dataTmp)
+		go myLog.doLog(errorType, "diskTier.put() err:"+err.Error())
+		return
+	}
+
+	if elem, ok := dt.items[name]; ok {
+		dt.size -= elem.Value.(*tierItem).size
+		dt.lru.Remove(elem)
+	}
+	dt.items[name] = dt.lru.PushFront(&tierItem{name: name, size: size})
+	dt.size += size
+	dt.evict()
+}
+
+// 从本地磁盘缓存中删除文件，删除之前开始的写入都会被丢弃
+func (dt *diskTier) remove(key string) {
+	name := tierName(key)
+
+	<-dt.mu
+	defer func() { dt.mu <- true }()
+
+	// 记录表太大时清空，清空之前开始的写入全部丢弃
+	dt.seq++
+	if len(dt.removed) > 100000 {
+		dt.removed = make(map[string]uint64)
+		dt.floor = dt.seq
+	}
+	dt.removed[name] = dt.seq
+
+	if elem, ok := dt.items[name]; ok {
+		dt.size -= elem.Value.(*tierItem).size
+		dt.lru.Remove(elem)
+		delete(dt.items, name)
+	}
+	os.Remove(filepath.Join(dt.dir, name))
+	os.Remove(filepath.Join(dt.dir, name+tierMetaSuffix))
+}
+
+// 本地磁盘缓存中的一个文件以及它的元数据
+type tierEntry struct {
+	meta tierMeta
+	size int64
+}
+
+// 返回本地磁盘缓存中所有有元数据的文件
+func (dt *diskTier) entries() []tierEntry {
+	<-dt.mu
+	items := make([]tierItem, 0, len(dt.items))
+	for _, elem := range dt.items {
+		items = append(items, *elem.Value.(*tierItem))
+	}
+	dt.mu <- true
+
+	entries := make([]tierEntry, 0, len(items))
+	for _, item := range items {
+		meta, err := dt.readMeta(item.name)
+		if err != nil || meta.Key == "" {
+			continue
+		}
+		entries = append(entries, tierEntry{meta: meta, size: item.size})
+	}
+	return entries
+}
+
+// 超过容量上限时从LRU的末尾开始淘汰，调用方需要持有锁
+func (dt *diskTier) evict() {
+	for dt.size > dt.maxSize && dt.lru.Len() > 0 {
+		item := dt.lru.Remove(dt.lru.Back()).(*tierItem)
+		delete(dt.items, item.name)
+		dt.size -= item.size
+		os.Remove(filepath.Join(dt.dir, item.name))
+		os.Remove(filepath.Join(dt.dir, item.name+tierMetaSuffix))
+	}
+}
+
+// redis中的文件过期时降级写入本地磁盘缓存，元数据一起写入
+func (dt *diskTier) demote(key string, fields map[string]string) {
+	dt.put(key, []byte(fields["data"]), metaFromFields(key, fields), dt.generation())
+}
+
+// 从本地磁盘缓存或者源站读取文件，源站的读取次数达到准入条件后写入本地磁盘缓存
+func readThroughDiskTier(ctx context.Context, fr *fileRequest) ([]byte, error) {
+	if diskCache == nil || fr.policy.NeverCache {
+		return fetchOrigin(ctx, fr)
+	}
+	if data, meta, ok := diskCache.get(fr.key); ok {
+		meta.apply(fr)
+		return data, nil
+	}
+
+	gen := diskCache.generation()
+	data, err := fetchOrigin(ctx, fr)
+	if err != nil {
+		return nil, err
+	}
+	// 不能缓存的文件也不写入本地磁盘缓存
+	if fr.cacheable(len(data)) && diskCache.shouldAdmit(fr.key, len(data)) {
+		go diskCache.put(fr.key, data, metaFromRequest(fr), gen)
+	}
+	return data, nil
+}
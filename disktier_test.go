@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 在临时目录中创建本地磁盘缓存，容量上限的单位为字节
+func newTestDiskTier(t *testing.T, dir string, maxSize int64, admit int) *diskTier {
+	t.Helper()
+	oldDiskCache := setting.DiskCache
+	t.Cleanup(func() { setting.DiskCache = oldDiskCache })
+	setting.DiskCache.Dir = dir
+	setting.DiskCache.MaxSize = 1
+	setting.DiskCache.MaxItemSize = 0
+	setting.DiskCache.AdmitCount = admit
+
+	dt, err := newDiskTier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.maxSize = maxSize
+	return dt
+}
+
+func testTierMeta() tierMeta {
+	return tierMeta{ContentType: "text/plain", ETag: `"v1"`, Expires: time.Now().Add(time.Minute).Unix()}
+}
+
+func TestDiskTierAdmit(t *testing.T) {
+	dt := newTestDiskTier(t, t.TempDir(), 1<<20, 3)
+	for i := 1; i <= 3; i++ {
+		if got := dt.shouldAdmit("{a}", 10); got != (i == 3) {
+			t.Fatalf("read %d: shouldAdmit() = %v", i, got)
+		}
+	}
+	// 写入之后重新计数
+	if dt.shouldAdmit("{a}", 10) {
+		t.Fatal("shouldAdmit() after admit = true")
+	}
+
+	dt.maxItem = 5
+	for i := 0; i < 5; i++ {
+		if dt.shouldAdmit("{big}", 10) {
+			t.Fatal("shouldAdmit() for file larger than maxItemSize = true")
+		}
+	}
+}
+
+func TestDiskTierPutGet(t *testing.T) {
+	dir := t.TempDir()
+	dt := newTestDiskTier(t, dir, 1<<20, 1)
+	dt.put("{a}", []byte("hello"), testTierMeta(), dt.generation())
+
+	data, meta, ok := dt.get("{a}")
+	if !ok || string(data) != "hello" {
+		t.Fatalf("get() = %q, %v", data, ok)
+	}
+	if meta.Key != "{a}" || meta.ContentType != "text/plain" || meta.ETag != `"v1"` {
+		t.Fatalf("meta = %+v", meta)
+	}
+
+	// 重启后恢复
+	dt = newTestDiskTier(t, dir, 1<<20, 1)
+	if data, _, ok = dt.get("{a}"); !ok || string(data) != "hello" {
+		t.Fatalf("get() after restart = %q, %v", data, ok)
+	}
+}
+
+func TestDiskTierEvict(t *testing.T) {
+	dir := t.TempDir()
+	dt := newTestDiskTier(t, dir, 10, 1)
+	dt.put("{a}", []byte("aaaaaa"), testTierMeta(), dt.generation())
+	dt.put("{b}", []byte("bbbbbb"), testTierMeta(), dt.generation())
+
+	if _, _, ok := dt.get("{a}"); ok {
+		t.Fatal("least recently used file was not evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, tierName("{a}")+tierMetaSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("meta file of evicted file: %v", err)
+	}
+	if _, _, ok := dt.get("{b}"); !ok {
+		t.Fatal("newest file was evicted")
+	}
+
+	// 读取过的文件移到LRU的前面
+	dt.maxSize = 12
+	dt.put("{c}", []byte("cccccc"), testTierMeta(), dt.generation())
+	dt.get("{b}")
+	dt.put("{d}", []byte("dddddd"), testTierMeta(), dt.generation())
+	if _, _, ok := dt.get("{c}"); ok {
+		t.Fatal("c should be evicted before b")
+	}
+	if _, _, ok := dt.get("{b}"); !ok {
+		t.Fatal("recently read file was evicted")
+	}
+}
+
+func TestDiskTierExpired(t *testing.T) {
+	dir := t.TempDir()
+	dt := newTestDiskTier(t, dir, 1<<20, 1)
+
+	meta := testTierMeta()
+	meta.Expires = time.Now().Add(-time.Second).Unix()
+	dt.put("{a}", []byte("old"), meta, dt.generation())
+	if _, _, ok := dt.get("{a}"); ok {
+		t.Fatal("expired file was returned")
+	}
+	if _, err := os.Stat(filepath.Join(dir, tierName("{a}"))); !os.IsNotExist(err) {
+		t.Fatalf("expired file was not removed: %v", err)
+	}
+
+	// 没有元数据的文件无法判断是否过期
+	dt.put("{b}", []byte("legacy"), testTierMeta(), dt.generation())
+	os.Remove(filepath.Join(dir, tierName("{b}")+tierMetaSuffix))
+	if _, _, ok := dt.get("{b}"); ok {
+		t.Fatal("file without meta was returned")
+	}
+}
+
+func TestTierExpires(t *testing.T) {
+	now := time.Now().Unix()
+	if got := tierExpires(time.Hour, 0); got < now+3599 || got > now+3601 {
+		t.Fatalf("tierExpires(1h, 0) = now%+d", got-now)
+	}
+	if got := tierExpires(time.Hour, 60); got < now+59 || got > now+61 {
+		t.Fatalf("tierExpires(1h, 60) = now%+d", got-now)
+	}
+}
+
+// 删除之前开始的读取在删除之后才写入，旧文件不能回到本地磁盘缓存
+func TestDiskTierPutAfterRemove(t *testing.T) {
+	dt := newTestDiskTier(t, t.TempDir(), 1<<20, 1)
+
+	gen := dt.generation()
+	dt.remove("{a}")
+	dt.put("{a}", []byte("old"), testTierMeta(), gen)
+	if _, _, ok := dt.get("{a}"); ok {
+		t.Fatal("put started before remove was kept")
+	}
+
+	dt.put("{a}", []byte("new"), testTierMeta(), dt.generation())
+	if data, _, ok := dt.get("{a}"); !ok || string(data) != "new" {
+		t.Fatalf("get() = %q, %v", data, ok)
+	}
+
+	// 其他文件的删除不影响
+	gen = dt.generation()
+	dt.remove("{b}")
+	dt.put("{c}", []byte("c"), testTierMeta(), gen)
+	if _, _, ok := dt.get("{c}"); !ok {
+		t.Fatal("put of another file was dropped")
+	}
+}
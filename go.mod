@@ -2,11 +2,13 @@ module caching-middleware
 
 go 1.21.1
 
-require github.com/redis/go-redis/v9 v9.4.0
+require (
+	github.com/cespare/xxhash/v2 v2.2.0
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f
+	github.com/redis/go-redis/v9 v9.4.0
+)
 
 require (
 	github.com/bsm/ginkgo/v2 v2.12.0 // indirect
 	github.com/bsm/gomega v1.27.10 // indirect
-	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 )
@@ -0,0 +1,247 @@
+/*
+	此模块验证JWT，签名的公钥来自本地的JWKS文件(auth.jwks)，支持RS256和ES256。
+	JWKS文件在修改之后会自动重新加载，更换密钥时不需要重启。
+	token中的权限来自scope(空格分隔的字符串)或者scp(字符串数组)，
+	exp是必须的，配置了auth.issuer、auth.audience时还会检查iss、aud
+*/
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// JWKS中的一个公钥
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// 从JWKS文件加载的公钥
+type jwksKeys struct {
+	mu      chan bool
+	modTime time.Time
+	keys    map[string]crypto.PublicKey // kid到公钥的映射
+}
+
+var jwks = &jwksKeys{mu: make(chan bool, 1)}
+
+func init() {
+	jwks.mu <- true
+}
+
+// 返回kid对应的公钥，JWKS文件修改过时先重新加载
+func (jk *jwksKeys) get(kid string) (crypto.PublicKey, error) {
+	<-jk.mu
+	defer func() { jk.mu <- true }()
+
+	info, err := os.Stat(setting.Auth.JWKS)
+	if err != nil {
+		return nil, err
+	}
+	if !info.ModTime().Equal(jk.modTime) {
+		keys, err := loadJWKS(setting.Auth.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		jk.keys = keys
+		jk.modTime = info.ModTime()
+	}
+
+	key, ok := jk.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown kid %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+// 解析JWKS文件
+func loadJWKS(file string) (map[string]crypto.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(content, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %w", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// 把JWK转换为公钥
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %v", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %v", jwk.Kty)
+	}
+}
+
+// 验证JWT，返回token的主体(sub)以及权限
+func verifyJWT(token string) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, errInvalidToken
+	}
+	key, err := jwks.get(header.Kid)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 算法由公钥的类型决定，不能相信token中的alg
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], sig) != nil {
+			return "", nil, errInvalidToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return "", nil, errInvalidToken
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return "", nil, errInvalidToken
+		}
+	default:
+		return "", nil, errInvalidToken
+	}
+
+	var claims struct {
+		Sub   string          `json:"sub"`
+		Iss   string          `json:"iss"`
+		Aud   json.RawMessage `json:"aud"`
+		Exp   *int64          `json:"exp"`
+		Nbf   *int64          `json:"nbf"`
+		Scope string          `json:"scope"`
+		Scp   []string        `json:"scp"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().Unix()
+	if claims.Exp == nil || now >= *claims.Exp {
+		return "", nil, fmt.Errorf("%w: expired", errInvalidToken)
+	}
+	if claims.Nbf != nil && now < *claims.Nbf {
+		return "", nil, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	}
+	if setting.Auth.Issuer != "" && claims.Iss != setting.Auth.Issuer {
+		return "", nil, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	}
+	if setting.Auth.Audience != "" && !hasAudience(claims.Aud, setting.Auth.Audience) {
+		return "", nil, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+
+	scopes := append(strings.Fields(claims.Scope), claims.Scp...)
+	return "jwt:" + claims.Sub, scopes, nil
+}
+
+// 解析JWT的header或者payload
+func decodeJWTPart(part string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidToken
+	}
+	if json.Unmarshal(content, v) != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+// aud可以是字符串也可以是字符串数组
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 用来签发token的私钥
+type testSigner struct {
+	kid string
+	alg string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func (s testSigner) sign(t *testing.T, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	if header == nil {
+		header = map[string]interface{}{"alg": s.alg, "kid": s.kid}
+	}
+	encode := func(v interface{}) string {
+		content, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(content)
+	}
+	signing := encode(header) + "." + encode(claims)
+	hash := sha256.Sum256([]byte(signing))
+
+	var sig []byte
+	var err error
+	if s.rsa != nil {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, hash[:])
+	} else {
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, hash[:])
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// 生成RSA和EC的密钥，把公钥写入JWKS文件
+func newTestJWKS(t *testing.T) (testSigner, testSigner, testSigner) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不在JWKS中的密钥，用它签发的token不能通过验证
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string][]jsonWebKey{"keys": {
+		{Kty: "RSA", Kid: "rsa", Alg: "RS256", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Alg: "ES256", Crv: "P-256", X: b64(ecKey.X.FillBytes(make([]byte, 32))), Y: b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldAuth := setting.Auth
+	t.Cleanup(func() { setting.Auth = oldAuth })
+	setting.Auth.JWKS = file
+	setting.Auth.Issuer = "https://issuer.example.com"
+	setting.Auth.Audience = "caching-middleware"
+	// 之前的测试加载过的公钥不能再使用
+	<-jwks.mu
+	jwks.modTime = time.Time{}
+	jwks.mu <- true
+
+	return testSigner{kid: "rsa", alg: "RS256", rsa: rsaKey},
+		testSigner{kid: "ec", alg: "ES256", ec: ecKey},
+		testSigner{kid: "ec", alg: "ES256", ec: otherKey}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaSigner, ecSigner, otherSigner := newTestJWKS(t)
+
+	now := time.Now().Unix()
+	claims := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "alice",
+			"iss":   "https://issuer.example.com",
+			"aud":   "caching-middleware",
+			"exp":   now + 60,
+			"scope": "upload delete",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantSub    string
+		wantScopes []string
+	}{
+		{name: "RS256", token: rsaSigner.sign(t, nil, claims(nil)), wantSub: "jwt:alice", wantScopes: []string{"upload", "delete"}},
+		{name: "ES256", token: ecSigner.sign(t, nil, claims(nil)), wantSub: "jwt:alice", wantScopes: []string{"upload", "delete"}},
+		{
+			name: "audience list and scp",
+			token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) {
+				c["aud"] = []string{"other", "caching-middleware"}
+				c["scope"] = ""
+				c["scp"] = []string{"admin"}
+			})),
+			wantSub:    "jwt:alice",
+			wantScopes: []string{"admin"},
+		},
+		{name: "expired", token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) { c["exp"] = now - 1 }))},
+		{name: "no exp", token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) { delete(c, "exp") }))},
+		{name: "not valid yet", token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) { c["nbf"] = now + 60 }))},
+		{name: "wrong issuer", token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }))},
+		{name: "wrong audience", token: ecSigner.sign(t, nil, claims(func(c map[string]interface{}) { c["aud"] = "other" }))},
+		{name: "signed by unknown key", token: otherSigner.sign(t, nil, claims(nil))},
+		{name: "unknown kid", token: ecSigner.sign(t, map[string]interface{}{"alg": "ES256", "kid": "missing"}, claims(nil))},
+		{name: "alg does not match key", token: ecSigner.sign(t, map[string]interface{}{"alg": "RS256", "kid": "ec"}, claims(nil))},
+		{name: "alg none", token: ecSigner.sign(t, map[string]interface{}{"alg": "none", "kid": "ec"}, claims(nil))},
+		{name: "malformed", token: "not.a.token"},
+		{name: "two parts", token: "a.b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, scopes, err := verifyJWT(tt.token)
+			if tt.wantSub == "" {
+				if err == nil {
+					t.Fatalf("verifyJWT() = %v, %v, want error", sub, scopes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyJWT() err = %v", err)
+			}
+			if sub != tt.wantSub || !reflect.DeepEqual(scopes, tt.wantScopes) {
+				t.Fatalf("verifyJWT() = %v, %v, want %v, %v", sub, scopes, tt.wantSub, tt.wantScopes)
+			}
+		})
+	}
+}
+
+// 篡改payload之后签名不能通过验证
+func TestVerifyJWTTamperedPayload(t *testing.T) {
+	_, ecSigner, _ := newTestJWKS(t)
+	token := ecSigner.sign(t, nil, map[string]interface{}{
+		"sub": "alice", "iss": "https://issuer.example.com", "aud": "caching-middleware", "exp": time.Now().Unix() + 60,
+	})
+	forged, _ := json.Marshal(map[string]interface{}{
+		"sub": "admin", "iss": "https://issuer.example.com", "aud": "caching-middleware", "exp": time.Now().Unix() + 60,
+	})
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	_, _, err := verifyJWT(parts[0] + "." + parts[1] + "." + parts[2])
+	if !errors.Is(err, errInvalidToken) {
+		t.Fatalf("verifyJWT() err = %v, want %v", err, errInvalidToken)
+	}
+}
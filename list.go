@@ -0,0 +1,272 @@
+/*
+	此模块实现源站目录的列表和搜索接口(只支持本地文件系统源站)。
+	GET /list?ns=&dir=&pattern=&recursive=&sort=&order=&page=&size=
+	dir        要列出的目录，相对于源站目录，为空时为源站目录本身
+	pattern    文件名的glob，例如*.mp4，recursive=true时匹配相对于dir的路径，例如videos/*.mp4
+	recursive  为true时列出dir下面所有子目录中的文件，用来搜索
+	sort       name(默认)、size或者mtime，order为asc(默认)或者desc
+	page/size  分页，page从1开始，size默认为50，最大为1000
+	每个文件带有大小、修改时间、MineType中的类型，以及是否已经缓存(cached)、是否是热点数据(hot)。
+	配置了多个目录时合并所有目录的文件，同名的文件使用第一个目录中的。
+	目录的扫描结果在进程内缓存listCacheTTL秒，避免频繁的列表请求压垮文件系统
+*/
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListPageSize = 50
+	maxListPageSize     = 1000
+	maxListEntries      = 100000 // 一次扫描最多的文件数
+)
+
+// 列表中的一项
+type listEntry struct {
+	Name    string    `json:"name"` // 相对于源站目录的路径
+	Dir     bool      `json:"dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Type    string    `json:"type,omitempty"`
+	Cached  bool      `json:"cached"`
+	Hot     bool      `json:"hot"`
+}
+
+// 缓存的扫描结果
+type listScan struct {
+	entries  []listEntry
+	expireAt time.Time
+}
+
+// 进程内缓存的扫描结果，key为命名空间、目录以及是否递归
+var listCache = struct {
+	mu    chan bool
+	scans map[string]*listScan
+}{mu: make(chan bool, 1), scans: make(map[string]*listScan)}
+
+func init() {
+	listCache.mu <- true
+}
+
+// 处理列表请求
+func handleList(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, readScope) {
+		return
+	}
+	query := r.URL.Query()
+	ns, ok := namespaceByName(query.Get("ns"))
+	if !ok {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return
+	}
+	lo, ok := ns.origin.(*localOrigin)
+	if !ok {
+		http.Error(w, "origin of this namespace can not be listed", http.StatusBadRequest)
+		return
+	}
+	dir := strings.Trim(query.Get("dir"), "/")
+	if dir != "" {
+		if _, ok = cleanUploadName(dir); !ok {
+			http.Error(w, "invalid dir", http.StatusBadRequest)
+			return
+		}
+	}
+	pattern := query.Get("pattern")
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, "invalid pattern", http.StatusBadRequest)
+		return
+	}
+	recursive := query.Get("recursive") == "true"
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	size, _ := strconv.Atoi(query.Get("size"))
+	if size < 1 {
+		size = defaultListPageSize
+	}
+	if size > maxListPageSize {
+		size = maxListPageSize
+	}
+
+	entries, err := scanOrigin(lo, ns, dir, recursive)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "dir not found", http.StatusNotFound)
+			return
+		}
+		go myLog.doLog(errorType, "handleList() err:"+err.Error())
+		http.Error(w, "failed to list dir", http.StatusInternalServerError)
+		return
+	}
+
+	// 过滤
+	if pattern != "" {
+		matched := make([]listEntry, 0, len(entries))
+		for _, entry := range entries {
+			rel := strings.TrimPrefix(strings.TrimPrefix(entry.Name, dir), "/")
+			if ok, _ := path.Match(pattern, rel); ok {
+				matched = append(matched, entry)
+			}
+		}
+		entries = matched
+	} else {
+		entries = append([]listEntry(nil), entries...)
+	}
+
+	// 排序
+	less := func(i, j int) bool { return entries[i].Name < entries[j].Name }
+	switch query.Get("sort") {
+	case "size":
+		less = func(i, j int) bool { return entries[i].Size < entries[j].Size }
+	case "mtime":
+		less = func(i, j int) bool { return entries[i].ModTime.Before(entries[j].ModTime) }
+	}
+	if query.Get("order") == "desc" {
+		asc := less
+		less = func(i, j int) bool { return asc(j, i) }
+	}
+	sort.SliceStable(entries, less)
+
+	// 分页，只查询当前页的缓存状态
+	total := len(entries)
+	start := (page - 1) * size
+	if start > total {
+		start = total
+	}
+	end := start + size
+	if end > total {
+		end = total
+	}
+	entries = entries[start:end]
+	for i := range entries {
+		if !entries[i].Dir {
+			entries[i].Cached, entries[i].Hot = cacheStatus(r.Context(), ns, entries[i].Name)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"namespace": ns.name,
+		"dir":       dir,
+		"page":      page,
+		"size":      size,
+		"total":     total,
+		"entries":   entries,
+	})
+}
+
+// 返回文件是否已经缓存，是否是热点数据
+func cacheStatus(ctx context.Context, ns *namespace, name string) (cached bool, hot bool) {
+	fr := newFileRequest(ns, name, nil)
+	if store.Available(fr.key) != nil {
+		return false, false
+	}
+	_, err := store.HGet(ctx, fr.key, "size")
+	cached = err == nil
+	access, err := store.HGet(ctx, fr.key, "access")
+	if err == nil {
+		n, _ := strconv.Atoi(access)
+		hot = n > fr.policy.ExtendCount
+	}
+	return cached, hot || pins.has(fr.key)
+}
+
+// 扫描源站目录，结果在进程内缓存一段时间
+func scanOrigin(lo *localOrigin, ns *namespace, dir string, recursive bool) ([]listEntry, error) {
+	cacheKey := ns.name + "\x00" + dir + "\x00" + strconv.FormatBool(recursive)
+	ttl := time.Duration(setting.ListCacheTTL) * time.Second
+
+	<-listCache.mu
+	scan, ok := listCache.scans[cacheKey]
+	listCache.mu <- true
+	if ok && time.Now().Before(scan.expireAt) {
+		return scan.entries, nil
+	}
+
+	// 合并每个目录中的文件，同名的使用第一个目录中的
+	seen := make(map[string]bool)
+	var entries []listEntry
+	found := false
+	for _, root := range lo.roots {
+		base := filepath.Join(root.path, filepath.FromSlash(dir))
+		if _, err := os.Stat(base); err != nil {
+			continue
+		}
+		found = true
+		err := scanDir(base, dir, recursive, func(entry listEntry) {
+			if !seen[entry.Name] && len(entries) < maxListEntries {
+				seen[entry.Name] = true
+				entries = append(entries, entry)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	if ttl > 0 {
+		<-listCache.mu
+		// 不同的参数太多时直接清空
+		if len(listCache.scans) > 1000 {
+			listCache.scans = make(map[string]*listScan)
+		}
+		listCache.scans[cacheKey] = &listScan{entries: entries, expireAt: time.Now().Add(ttl)}
+		listCache.mu <- true
+	}
+	return entries, nil
+}
+
+// 扫描一个目录，隐藏文件(例如上传的临时文件)不列出
+func scanDir(base string, dir string, recursive bool, fn func(listEntry)) error {
+	return filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == base {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			// 扫描过程中文件被删除
+			return nil
+		}
+		rel, _ := filepath.Rel(base, p)
+		entry := listEntry{
+			Name:    path.Join(dir, filepath.ToSlash(rel)),
+			Dir:     d.IsDir(),
+			ModTime: info.ModTime(),
+		}
+		if !entry.Dir {
+			entry.Size = info.Size()
+			entry.Type, _ = setting.MineType[getFileSuffix(entry.Name)].(string)
+		}
+		// 递归时只列出文件
+		if !recursive || !entry.Dir {
+			fn(entry)
+		}
+		if d.IsDir() && !recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
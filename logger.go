@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -130,7 +131,8 @@ func (myLog *MyLogger) Listener() {
 		// 计算统计数据信号
 		case <-c.cticker.C:
 			ratio := c.cal()
-			myLog.doLog(dailyType, "redis:"+ratio+"%")
+			shed := strconv.FormatInt(originSlots.shedCount(), 10)
+			myLog.doLog(dailyType, "redis:"+ratio+"% egress:"+c.throughput()+"KB/s shed:"+shed)
 		}
 
 	}
@@ -154,7 +156,11 @@ func (myLog *MyLogger) setTicker() {
 
 // 记录日志操作，由调用方传入使用的logger类型以及记录的字符串
 // 这里不需要担心数据截断问题，在bufio.writer更换文件时会flush
+// 日志还没有创建时(例如测试或者生成签名链接的命令)直接丢弃
 func (ml *MyLogger) doLog(name string, content string) {
+	if ml == nil {
+		return
+	}
 	switch name {
 	case dailyType:
 		if enable {
@@ -23,37 +23,89 @@ type counter struct {
 	mu      chan bool
 	count   int
 	total   int
+	sent    int64     // 上次统计之后返回给客户端的字节数
+	since   time.Time // 上次统计吞吐量的时间
 }
 
-var rdb *redis.Client       // 全局的go-redis里的redis客户端，通过这个访问redis
-var myLog *MyLogger         // 全局的日志对象，用来记录日志
-var setting Settings        // 全局的参数对象，使用参数
-var exitChan chan os.Signal // 退出信号接受的channel
-var c *counter              // 计算统计数据的变量
+var rdb redis.UniversalClient // 全局的go-redis里的redis客户端，通过这个访问redis
+var myLog *MyLogger           // 全局的日志对象，用来记录日志
+var setting Settings          // 全局的参数对象，使用参数
+var exitChan chan os.Signal   // 退出信号接受的channel
+var c *counter                // 计算统计数据的变量
 
 func init() {
 
 	// 解析配置文件中的参数
 	parseConfig()
 
+	// 读取签名链接的密钥
+	var err error
+	signKeys, err = loadSignKeys()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+
+	// 命令行生成签名链接时只需要配置和命名空间
+	if isSignCommand() {
+		err = newNamespaces()
+		if err != nil {
+			fmt.Println("err:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// 初始化counter变量
 	c = initCounter()
 
-	rdb = redis.NewClient(&redis.Options{
-		Addr:     setting.RdbIp + setting.RdpPort,
-		Password: setting.RdpPort, // 没有密码，默认值
-		DB:       setting.DB,      // 默认DB 0
+	// 创建缓存仓库，密码文件或者TLS证书有问题时无法安全地连接redis，直接退出
+	store, err = newCacheStore()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
 
-		PoolSize:     setting.PoolSize,     //最大连接数
-		MinIdleConns: setting.MinIdleConns, //最小空闲连接数
-		MaxIdleConns: setting.MaxIdleConns, //最大空闲连接数
+	// 创建所有命名空间以及它们的源站
+	err = newNamespaces()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
 
-		PoolTimeout: time.Duration(setting.PoolTimeout) * time.Second, //等待连接最长时间，这里设置为5s
-	})
+	// 创建本地磁盘缓存
+	if setting.DiskCache.Enable {
+		diskCache, err = newDiskTier()
+		if err != nil {
+			fmt.Println("err:", err)
+			os.Exit(1)
+		}
+	}
+
+	// 创建带宽限制的令牌桶
+	initBandwidth()
+
+	// 创建读取源站的名额
+	originSlots = newOriginLimiter(setting.OriginConcurrency.MaxConcurrent)
+
+	// 创建负缓存
+	negative = newNegativeCache(time.Duration(setting.NegativeTTL) * time.Second)
+
+	// 恢复固定的文件
+	pins, err = newPinSet(setting.PinFile)
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
 
 }
 
 func main() {
+	if isSignCommand() {
+		runSignCommand(os.Args[2:])
+		return
+	}
+
 	exitChan = make(chan os.Signal, 1)
 	signal.Notify(exitChan, os.Interrupt, os.Kill)
 
@@ -63,11 +115,64 @@ func main() {
 	// 启动一个协程，让其监听timer对channel的操作
 	go myLog.Listener()
 
+	// 启动分片的健康检查
+	if shards != nil {
+		go shards.healthCheck()
+	}
+
+	// 启动源站目录的健康检查
+	for _, ns := range allNamespaces() {
+		if lo, ok := ns.origin.(*localOrigin); ok && len(lo.roots) > 1 {
+			go lo.healthCheck()
+		}
+	}
+
+	// 定时汇总不存在的文件
+	missLogInterval := time.Duration(setting.MissLogInterval) * time.Second
+	if missLogInterval <= 0 {
+		missLogInterval = time.Minute
+	}
+	go negative.report(missLogInterval)
+
+	// 发现源站文件的变化
+	if setting.WatchOrigin {
+		err := watchOrigin()
+		if err != nil {
+			myLog.doLog(errorType, "watchOrigin() err:"+err.Error())
+		}
+	}
+	if setting.RevalidateInterval > 0 {
+		go revalidateSweep(time.Duration(setting.RevalidateInterval) * time.Second)
+	}
+
+	// 删除过期的断点续传数据
+	go cleanTusUploads(10 * time.Minute)
+
+	// 清空回收站中过期的文件
+	if setting.Trash.Dir != "" {
+		go cleanTrash(time.Hour)
+	}
+
+	// 把固定的文件重新加载到缓存
+	go pins.restore()
+
+	// redis中的文件过期时降级到本地磁盘缓存
+	if diskCache != nil && setting.DiskCache.Demote {
+		store.OnExpire(diskCache.demote)
+	}
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/greet", greetingHandler)
-	mux.HandleFunc("/download", handleRequestFile)
-	mux.HandleFunc("/flush", handledFlush)
+	handleLimited(mux, "/greet", greetingHandler)
+	handleLimited(mux, "/download", handleRequestFile)
+	handleLimited(mux, "/download/", handleRequestFile)
+	handleLimited(mux, "/flush", handledFlush)
+	handleLimited(mux, "/admin/pins", handlePins)
+	handleLimited(mux, "/list", handleList)
+	handleLimited(mux, "/upload", handleUpload)
+	handleLimited(mux, "/admin/files", handleDeleteFile)
+	handleLimited(mux, "/admin/sign", handleSign)
+	handleLimited(mux, "/tus/", handleTus)
 
 	fmt.Println("hahaha")
 	myLog.doLog(dailyType, "server start! welcome")
@@ -79,6 +184,9 @@ func main() {
 }
 
 func handledFlush(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, purgeScope) {
+		return
+	}
 
 	query := r.URL.Query()
 	fileName := query.Get("file")
@@ -103,73 +211,169 @@ func greetingHandler(w http.ResponseWriter, r *http.Request) {
 // 处理请求文件逻辑
 func handleRequestFile(w http.ResponseWriter, r *http.Request) {
 
-	// 获取参数,拼接出文件名及文件的磁盘路径
+	// 根据路径或者Host选择命名空间
+	ns, ok := resolveNamespace(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// 获取参数,拼接出文件名
 	query := r.URL.Query()
-	fileName := query.Get("file") + setting.Suffix
-	filePath := setting.Prefix + fileName
+	fileName, ok := cleanFileName(query.Get("file") + ns.suffix)
+	if !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+
+	// 要求签名链接时验证签名，签名本身就是凭证；否则需要read权限
+	if setting.SignedURL.Require {
+		if err := verifySignedURL(r, ns, fileName); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	} else if !requireScope(w, r, readScope) {
+		return
+	}
+	fr := newFileRequest(ns, fileName, r.Header)
+
+	// 整个请求的截止时间，客户端断开连接时r.Context()也会被取消
+	ctx, cancel := requestCtx(r.Context())
+	defer cancel()
 
 	// 获取文件,以[]byte形式
-	data, err := getFile(fileName, filePath)
+	data, err := getFile(ctx, fr)
+	// 客户端已经断开连接，不需要返回数据
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	// 返回的数据受带宽限制
+	w = shapeResponse(w, r, len(data))
 	if err != nil {
 		// myLog.errorLogger.Printf("%v\n", err)
-		go myLog.doLog(errorType, "getFile err:"+err.Error())
-		fmt.Println("err1:", err)
+		logOriginErr("getFile", err)
 		if errors.Is(err, os.ErrNotExist) {
+			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprint(w, "您请求的数据服务器中不存在，请联系管理员")
+		} else if errors.Is(err, errOriginUnavailable) && data == nil {
+			w.WriteHeader(http.StatusBadGateway)
+		} else if errors.Is(err, errOriginBusy) && data == nil {
+			// 源站太忙，让客户端稍后再试
+			w.Header().Set("Retry-After", strconv.Itoa(originRetryAfter()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if errors.Is(err, context.DeadlineExceeded) && data == nil {
+			// 超过了请求、读硬盘或者源站目录的截止时间
+			w.WriteHeader(http.StatusGatewayTimeout)
+		} else if data == nil {
+			w.WriteHeader(http.StatusInternalServerError)
 		}
 		if data != nil {
 			// myLog.dailyLogger.Println("get from disk:", filePath)
 			//myLog.doLog(dailyType, "get from disk"+filePath)
-			fileSuffix := getFileSuffix(fileName)
-			w.Header().Set("Content-Type", setting.MineType[fileSuffix].(string))
-			w.Write(data)
+			writeFile(w, fr, data)
 		}
 		return
 	}
 
 	// 指定返回头中的disposition-content,让浏览器以附件的形式下载文件
 
-	fileSuffix := getFileSuffix(fileName)
-	w.Header().Set("Content-Type", setting.MineType[fileSuffix].(string))
 	// w.Header().Set("content-disposition", "attachment;filename="+fileName)
+	writeFile(w, fr, data)
+}
+
+// 将文件返回给客户端，客户端的If-None-Match与文件的ETag一致时返回304
+func writeFile(w http.ResponseWriter, fr *fileRequest, data []byte) {
+	w.Header().Set("Content-Type", getContentType(fr))
+	setStaleHeaders(w, fr)
+	if fr.etag != "" {
+		w.Header().Set("ETag", fr.etag)
+		if fr.header.Get("If-None-Match") == fr.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
 	w.Write(data)
 }
 
+// 获取文件的Content-Type，优先使用MineType表，表中没有时使用源站返回的类型
+func getContentType(fr *fileRequest) string {
+	if mineType, ok := setting.MineType[getFileSuffix(fr.name)].(string); ok {
+		return mineType
+	}
+	if fr.contentType != "" {
+		return fr.contentType
+	}
+	return "application/octet-stream"
+}
+
 /*
 获取文件，并将文件发送给浏览器
 具体功能:
 redis中存在就从redis中加载,redis中不存在就从硬盘加载，并将内容加载到redis中
 */
-func getFile(fileName string, filePath string) (data []byte, err error) {
+func getFile(ctx context.Context, fr *fileRequest) (data []byte, err error) {
+
+	// 请求已经被取消，不需要再做任何事情
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// 文件在redis中的key
+	fileName := fr.name
+	key := fr.key
+
+	// 固定的文件总是从缓存返回
+	if pins.has(key) {
+		return getPinnedFile(ctx, fr)
+	}
+
+	// 规则禁止缓存的文件直接从源站加载
+	if fr.policy.NeverCache {
+		return getFileFromDisk(ctx, fr)
+	}
 
 	// 尝试从redis中获取数据
 	// 判断key是否存在于redis中
-	exist, err := rdb.Exists(context.Background(), fileName).Result()
+	// 分片不可用或者熔断器打开时直接从硬盘加载，不再访问redis
+	if err = store.Available(key); err != nil {
+		return getFileFromDisk(ctx, fr)
+	}
+	exist, err := store.Exists(ctx, key)
 	if err != nil {
 		// myLog.errorLogger.Println("getFile() err:", err)
 		go myLog.doLog(errorType, "getFile() err:"+err.Error())
+		return getFileFromDisk(ctx, fr)
 	}
 
 	// 文件key存在
-	if exist == 1 {
+	if exist {
+		// 不能缓存的文件不再计算访问次数，直接从源站加载
+		if isUncacheable(ctx, key) {
+			return getFileFromDisk(ctx, fr)
+		}
+
 		// 先给文件的access++
-		err = increseAccess(fileName)
+		err = increseAccess(ctx, key)
 		if err != nil {
 			// myLog.errorLogger.Panicln("getFile() err:", err)
 			go myLog.doLog(errorType, "getFile() err:"+err.Error())
 		}
 
 		// 判断文件是否是热点数据，是否需要延长其存活时间
-		if isHotkey(fileName) {
+		if isHotkey(ctx, fr) {
 			// 是热点数据，延长其存活时间并返回数据
-			data, err = getFileFromRedis(fileName)
+			data, err = getFileFromRedis(ctx, fr)
+			// 缓存中只有访问次数没有数据，从源站加载
+			if errors.Is(err, errCacheMiss) {
+				return getFileFromDisk(ctx, fr)
+			}
 			if err != nil {
 				// myLog.errorLogger.Println("getFile() err:", err)
 				go myLog.doLog(errorType, "getFile() err:"+err.Error())
 				return data, err
 			}
 
-			err = setTTL(fileName, time.Duration(setting.HotTTL)*time.Minute)
+			err = extendFile(ctx, fr, fr.ttl(fr.policy.HotTTL))
 			if err != nil {
 				// myLog.errorLogger.Println("getFile() err:", err)
 				go myLog.doLog(errorType, "getFile() err:"+err.Error())
@@ -181,24 +385,30 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 				myLog.doLog(dailyType, fmt.Sprintf("%v has extender its ttl", fileName))
 				c.countIncr()
 				c.totalIncr()
-				myLog.doLog(dailyType, "get from redis"+filePath)
+				myLog.doLog(dailyType, "get from redis"+fileName)
 			}()
 			return
 		}
 
 		// 判断文件是否需要缓存
-		if isLoadToRedis(fileName) { //>5
+		if isLoadToRedis(ctx, fr) { //>5
 			// 文件访问数达到6，说明还没缓存但是需要缓存
-			if getFileAccess(fileName) == int64(setting.LoadCount+1) {
-				data, err = getFileStream(filePath)
+			if getFileAccess(ctx, key) == int64(fr.policy.LoadCount+1) {
+				data, err = readThroughDiskTier(ctx, fr)
 				// 从硬盘获取文件错误，没有数据返回
 				if err != nil {
 					// myLog.errorLogger.Println("getFile() err:", err)
-					myLog.doLog(errorType, "getFile() err:"+err.Error())
+					logOriginErr("getFile()", err)
 					return nil, err
 				}
+				// 上游不允许缓存或者文件太大，记录下来，之后的请求直接从源站加载
+				if !fr.cacheable(len(data)) {
+					markUncacheable(ctx, key)
+					go c.totalIncr()
+					return
+				}
 				// 将获得的字节流加载到redis中
-				err = loadFileToRedis(fileName, data)
+				err = loadFileToRedis(ctx, fr, data)
 				if err != nil {
 					// myLog.errorLogger.Printf("loadFileToRedis err:%v\n", err)
 					go myLog.doLog(errorType, "loadFileToRedis err:"+err.Error())
@@ -225,7 +435,11 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 				}
 				return
 			} else { // 这些是已经缓存了的但是还没被延长ttl的文件
-				data, err = getFileFromRedis(fileName)
+				data, err = getFileFromRedis(ctx, fr)
+				// 缓存中只有访问次数没有数据，从源站加载
+				if errors.Is(err, errCacheMiss) {
+					return getFileFromDisk(ctx, fr)
+				}
 				if err != nil {
 					// myLog.errorLogger.Println("getFile() err:", err)
 					go myLog.doLog(errorType, "getFile() err:"+err.Error())
@@ -235,7 +449,7 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 				go func() {
 					c.countIncr()
 					c.totalIncr()
-					myLog.doLog(dailyType, "get from redis"+filePath)
+					myLog.doLog(dailyType, "get from redis"+fileName)
 				}()
 
 				return
@@ -243,10 +457,10 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 		}
 
 		// 不需要缓存，从硬盘加载后返回即可
-		data, err = getFileStream(filePath)
+		data, err = readThroughDiskTier(ctx, fr)
 		if err != nil {
 			// myLog.errorLogger.Println("getFile() err:", err)
-			go myLog.doLog(errorType, "getFile() err:"+err.Error())
+			logOriginErr("getFile()", err)
 			return nil, err
 		}
 		// myLog.dailyLogger.Println("get from disk:" /*filePath*/)
@@ -262,20 +476,29 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 	// 创建文件的key,设置文件的access
 
 	// 获得文件的字节流
-	data, err = getFileStream(filePath)
+	data, err = readThroughDiskTier(ctx, fr)
 	if err != nil {
 		// myLog.errorLogger.Printf("getFile() err:%v\n", err)
-		go myLog.doLog(errorType, "getFile() err:"+err.Error())
+		logOriginErr("getFile()", err)
 		return nil, err
 	}
 
 	// 将数据返回并且创建这个key的access
-	err = loadAccessToRedis(fileName, 1)
+	err = loadAccessToRedis(ctx, fr, 1)
 	if err != nil {
 		// myLog.errorLogger.Printf("getFile() err:%v\n", err)
 		go myLog.doLog(errorType, "getFile() err:"+err.Error())
 		return data, err
 	}
+	// loadCount为0时第一次访问就缓存
+	if fr.policy.LoadCount == 0 {
+		if !fr.cacheable(len(data)) {
+			markUncacheable(ctx, key)
+		} else if err = loadFileToRedis(ctx, fr, data); err != nil {
+			go c.totalIncr()
+			return data, err
+		}
+	}
 	// myLog.dailyLogger.Println("get from disk:" /*filePath*/)
 	go func() {
 		c.totalIncr()
@@ -285,15 +508,60 @@ func getFile(fileName string, filePath string) (data []byte, err error) {
 	return
 }
 
+// redis不可用时直接从硬盘加载文件，不记录访问次数
+func getFileFromDisk(ctx context.Context, fr *fileRequest) (data []byte, err error) {
+	data, err = readThroughDiskTier(ctx, fr)
+	if err != nil {
+		return nil, err
+	}
+	go c.totalIncr()
+	return data, nil
+}
+
+// 从缓存获取固定的文件，缓存中没有时(例如redis被清空)从源站重新加载
+func getPinnedFile(ctx context.Context, fr *fileRequest) (data []byte, err error) {
+	if err = store.Available(fr.key); err != nil {
+		return getFileFromDisk(ctx, fr)
+	}
+	data, err = getFileFromRedis(ctx, fr)
+	if err == nil {
+		go func() {
+			c.countIncr()
+			c.totalIncr()
+		}()
+		return data, nil
+	}
+
+	data, err = readThroughDiskTier(ctx, fr)
+	if err != nil {
+		logOriginErr("getPinnedFile()", err)
+		return nil, err
+	}
+	err = loadFileToRedis(ctx, fr, data)
+	if err != nil {
+		go myLog.doLog(errorType, "getPinnedFile() err:"+err.Error())
+	}
+	go c.totalIncr()
+	return data, err
+}
+
 // 获取文件的字节流,相当于从硬盘加载数据
-func getFileStream(filePath string) (fileStream []byte, err error) {
+func getFileStream(ctx context.Context, filePath string) (fileStream []byte, err error) {
+
+	// 读硬盘的截止时间，请求被取消或者超时后停止读取
+	dctx, cancel := diskReadCtx(ctx)
+	defer cancel()
+	if err = dctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// 打开一个文件
 	file, err := os.Open(filePath)
 	if err != nil {
 		// fmt.Println("err:", err)
 		// myLog.errorLogger.Printf("getFileStream() open file err:%v", err)
-		go myLog.doLog(errorType, "getFileStream() open file err:"+err.Error())
+		// 文件不存在由负缓存汇总记录
+		logOriginErr("getFileStream() open file", err)
 		return
 	}
 	// 延迟关闭，避免内存泄露
@@ -306,39 +574,54 @@ func getFileStream(filePath string) (fileStream []byte, err error) {
 
 	// 循环读取文件，以字节流的形式
 	for {
+		if err = dctx.Err(); err != nil {
+			return nil, err
+		}
 		size, err := reader.Read(buf)
+		fileStream = append(fileStream, buf[:size]...)
 		// 当读到文件末尾时
-		if size == 0 || err == io.EOF {
+		if err == io.EOF {
 			break
 		}
-		fileStream = append(fileStream, buf[:size]...)
+		// 读取中途出错，返回错误，不能把读了一半的文件当作完整的文件
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return fileStream, nil
 }
 
-// 从redis获取文件
-func getFileFromRedis(key string) (result []byte, err error) {
-	str, err := rdb.HGet(context.Background(), key, "data").Result()
+// 从缓存获取文件，同时取出源站返回的元数据
+func getFileFromRedis(ctx context.Context, fr *fileRequest) (result []byte, err error) {
+	fields, err := store.HGetAll(ctx, fr.key)
+	if err == nil && (fields["data"] == "" || pastHardExpiry(fields)) {
+		err = errCacheMiss
+	}
 	if err != nil {
-		// 结果为空，redis中不存在数据
-		if err == redis.Nil {
-			// fmt.Println("文件不在内存中")
-			// myLog.errorLogger.Printf("getFileFromRedis() err:%v\n", err)
-			go myLog.doLog(errorType, "getFileFromRedis() err:"+err.Error())
-			return
-		} else {
-			// myLog.errorLogger.Printf("getFileFromRedis() err:%v\n", err)
+		// 结果为空，缓存中不存在数据，由调用方从源站加载
+		// myLog.errorLogger.Printf("getFileFromRedis() err:%v\n", err)
+		if err != errCacheMiss {
 			go myLog.doLog(errorType, "getFileFromRedis() err:"+err.Error())
-			return
 		}
+		return
+	}
+	fr.contentType = fields["type"]
+	fr.etag = fields["etag"]
+	if maxAge, err := strconv.Atoi(fields["maxage"]); err == nil {
+		fr.maxAge = time.Duration(maxAge) * time.Second
+	}
+	if mtime, err := strconv.ParseInt(fields["mtime"], 10, 64); err == nil && mtime != 0 {
+		fr.lastModified = time.Unix(0, mtime)
 	}
-	return []byte(str), err
+	// 过期的文件仍然返回，同时在后台重新加载
+	checkStale(fr, fields)
+	return []byte(fields["data"]), nil
 }
 
 // 获取文件的访问次数
-func getFileAccess(key string) int64 {
-	access, err := rdb.HGet(context.Background(), key, "access").Result()
+func getFileAccess(ctx context.Context, key string) int64 {
+	access, err := store.HGet(ctx, key, "access")
 	if err != nil {
 		// myLog.errorLogger.Println("getFileAccess() err:", err)
 		go myLog.doLog(errorType, "getFileAccess() err:"+err.Error())
@@ -348,16 +631,31 @@ func getFileAccess(key string) int64 {
 	return accessNum
 }
 
-// 将文件加载至redis中
-func loadFileToRedis(key string, fileStream []byte) (err error) {
-	err = rdb.HSet(context.Background(), key, "data", fileStream).Err()
+// 将文件以及源站返回的元数据加载至缓存中
+func loadFileToRedis(ctx context.Context, fr *fileRequest, fileStream []byte) (err error) {
+	key := fr.key
+	soft := fr.ttl(fr.policy.TTL)
+	fields := freshFields(soft)
+	// 固定的文件没有soft过期时间
+	if pins.has(key) {
+		fields["fresh"] = 0
+	}
+	fields["data"] = fileStream
+	fields["type"] = fr.contentType
+	fields["etag"] = fr.etag
+	fields["maxage"] = int64(fr.maxAge / time.Second)
+	fields["nocache"] = 0
+	for field, value := range versionFields(fr, fileStream) {
+		fields[field] = value
+	}
+	err = store.HSet(ctx, key, fields)
 	if err != nil {
 		// myLog.errorLogger.Printf("loadFileToRedis() err:%v\n", err)
 		go myLog.doLog(errorType, "loadFileToRedis() err:"+err.Error())
 		return
 	}
-	// 设置其ttl
-	err = setTTL(key, time.Duration(setting.TTL)*time.Minute)
+	// 设置其ttl，过期之后还可以作为过期文件返回staleTTL
+	err = setFileTTL(ctx, key, cacheTTL(soft))
 	if err != nil {
 		// myLog.errorLogger.Printf("loadFileToRedis() err:%v\n", err)
 		go myLog.doLog(errorType, "loadFileToRedis() err:"+err.Error())
@@ -366,16 +664,17 @@ func loadFileToRedis(key string, fileStream []byte) (err error) {
 	return
 }
 
-// 将文件的访问次数加载至redis中
-func loadAccessToRedis(key string, accessNum int) (err error) {
-	err = rdb.HSet(context.Background(), key, "access", accessNum).Err()
+// 将文件的访问次数加载至缓存中
+func loadAccessToRedis(ctx context.Context, fr *fileRequest, accessNum int) (err error) {
+	key := fr.key
+	err = store.HSet(ctx, key, map[string]interface{}{"access": accessNum})
 	if err != nil {
 		// myLog.errorLogger.Printf("loadAccessToRedis() err:%v\n", err)
 		go myLog.doLog(errorType, "loadAccessToRedis() err:"+err.Error())
 		return
 	}
 	// 设置其ttl
-	err = setTTL(key, time.Duration(setting.TTL)*time.Minute)
+	err = setTTL(ctx, key, fr.policy.TTL)
 	if err != nil {
 		// myLog.errorLogger.Printf("loadAccessToRedis() err:%v\n", err)
 		go myLog.doLog(errorType, "loadAccessToRedis() err:"+err.Error())
@@ -385,10 +684,14 @@ func loadAccessToRedis(key string, accessNum int) (err error) {
 }
 
 // 缓存策略，通过策略判断这个数据是否需要加入到缓存
-func isLoadToRedis(key string) bool {
-	accessNum := getFileAccess(key)
-	// 如果大于阈值，则加载到redis中
-	if accessNum > int64(setting.LoadCount) {
+func isLoadToRedis(ctx context.Context, fr *fileRequest) bool {
+	// 固定的文件不参与缓存策略的判断
+	if pins.has(fr.key) {
+		return true
+	}
+	accessNum := getFileAccess(ctx, fr.key)
+	// 如果大于阈值，则加载到缓存中
+	if accessNum > int64(fr.policy.LoadCount) {
 		return true
 	} else if accessNum == -1 {
 		// myLog.errorLogger.Println("isHotKey() err:key don't exist in redis")
@@ -400,15 +703,33 @@ func isLoadToRedis(key string) bool {
 
 }
 
+// 记录文件不能缓存，记录与访问次数一起过期，过期之后重新判断
+func markUncacheable(ctx context.Context, key string) {
+	err := store.HSet(ctx, key, map[string]interface{}{"nocache": 1})
+	if err != nil {
+		go myLog.doLog(errorType, "markUncacheable() err:"+err.Error())
+	}
+}
+
+// 文件是否被记录为不能缓存
+func isUncacheable(ctx context.Context, key string) bool {
+	value, err := store.HGet(ctx, key, "nocache")
+	return err == nil && value == "1"
+}
+
 // 缓存策略，判断这个key是否要延长其ttl
-func isHotkey(key string) bool {
-	accessNum := getFileAccess(key)
-	return accessNum > int64(setting.ExtendCount)
+func isHotkey(ctx context.Context, fr *fileRequest) bool {
+	accessNum := getFileAccess(ctx, fr.key)
+	return accessNum > int64(fr.policy.ExtendCount)
 }
 
 // 设置key的ttl
-func setTTL(key string, time time.Duration) error {
-	_, err := rdb.Expire(context.Background(), key, time).Result()
+func setTTL(ctx context.Context, key string, time time.Duration) error {
+	// 固定的文件永不过期
+	if pins.has(key) {
+		return store.Persist(ctx, key)
+	}
+	err := store.Expire(ctx, key, time)
 	if err != nil {
 		// myLog.errorLogger.Println("extendTTL() err:", err)
 		go myLog.doLog(errorType, "extendTTL() err:"+err.Error())
@@ -417,9 +738,21 @@ func setTTL(key string, time time.Duration) error {
 	return err
 }
 
+// 设置保存了文件数据的key的ttl，过期时文件可以降级到本地磁盘缓存
+func setFileTTL(ctx context.Context, key string, ttl time.Duration) error {
+	if pins.has(key) {
+		return store.Persist(ctx, key)
+	}
+	err := store.ExpireFile(ctx, key, ttl)
+	if err != nil {
+		go myLog.doLog(errorType, "setFileTTL() err:"+err.Error())
+	}
+	return err
+}
+
 // 使文件访问次数自增一
-func increseAccess(key string) (err error) {
-	_, err = rdb.HIncrBy(context.Background(), key, "access", 1).Result()
+func increseAccess(ctx context.Context, key string) (err error) {
+	_, err = store.HIncrBy(ctx, key, "access", 1)
 	if err != nil {
 		// myLog.errorLogger.Println("increseAccess() err:", err)
 		go myLog.doLog(errorType, "increseAccess() err:"+err.Error())
@@ -449,6 +782,7 @@ func initCounter() (c *counter) {
 
 	c.count = 0
 	c.total = 1
+	c.since = time.Now()
 	c.mu = make(chan bool, 1)
 	c.mu <- true
 	c.cticker = time.NewTicker(10 * time.Second)
@@ -480,6 +814,25 @@ func (c *counter) cal() string {
 	return strconv.Itoa(ratioInt)
 }
 
+// 增加返回给客户端的字节数
+func (c *counter) sentAdd(n int) {
+	<-c.mu
+	c.sent += int64(n)
+	c.mu <- true
+}
+
+// 返回上次统计之后的平均吞吐量，单位为KB/s，并重新开始统计
+func (c *counter) throughput() string {
+	<-c.mu
+	now := time.Now()
+	kbps := float64(c.sent) / 1024 / now.Sub(c.since).Seconds()
+	c.sent = 0
+	c.since = now
+	c.mu <- true
+
+	return strconv.FormatFloat(kbps, 'f', 1, 64)
+}
+
 // 重置
 func (c *counter) reset() {
 	<-c.mu
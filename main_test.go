@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 使用memory缓存仓库以及临时目录中的源站，测试结束后恢复全局变量
+func newTestNamespace(t *testing.T, policy cachePolicy) (*namespace, string) {
+	t.Helper()
+
+	oldStore, oldNegative, oldPins, oldDiskCache := store, negative, pins, diskCache
+	t.Cleanup(func() {
+		store, negative, pins, diskCache = oldStore, oldNegative, oldPins, oldDiskCache
+	})
+	store = newMemoryStore()
+	negative = newNegativeCache(0)
+	pins, _ = newPinSet("")
+	diskCache = nil
+
+	dir := t.TempDir()
+	lo, err := newLocalOrigin(dir+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &namespace{name: "test", keyPrefix: "test/", policy: policy, origin: lo}, dir
+}
+
+// 一次请求以及期望的结果
+type getFileStep struct {
+	write   string // 请求之前写入源站的内容，为空时不修改源站
+	want    string
+	wantErr error
+	cached  bool // 请求之后文件是否在缓存中
+}
+
+func TestGetFile(t *testing.T) {
+	policy := cachePolicy{LoadCount: 2, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour}
+
+	tests := []struct {
+		name   string
+		policy func(p cachePolicy) cachePolicy
+		steps  []getFileStep
+	}{
+		{
+			name: "cached after loadCount",
+			steps: []getFileStep{
+				{write: "v1", want: "v1"},
+				{want: "v1"},
+				{want: "v1", cached: true},
+				{want: "v1", cached: true},
+			},
+		},
+		{
+			name:   "loadCount 0 caches on first access",
+			policy: func(p cachePolicy) cachePolicy { p.LoadCount = 0; return p },
+			steps: []getFileStep{
+				{write: "v1", want: "v1", cached: true},
+				{want: "v1", cached: true},
+			},
+		},
+		{
+			name: "cached file is served after origin changes",
+			steps: []getFileStep{
+				{write: "v1", want: "v1"},
+				{want: "v1"},
+				{want: "v1", cached: true},
+				{write: "v2", want: "v1", cached: true},
+			},
+		},
+		{
+			name:   "hot file stays cached",
+			policy: func(p cachePolicy) cachePolicy { p.LoadCount = 1; p.ExtendCount = 3; return p },
+			steps: []getFileStep{
+				{write: "v1", want: "v1"},
+				{want: "v1", cached: true},
+				{want: "v1", cached: true},
+				{want: "v1", cached: true},
+				{want: "v1", cached: true},
+			},
+		},
+		{
+			name:   "file larger than maxSize is never cached",
+			policy: func(p cachePolicy) cachePolicy { p.MaxSize = 2; return p },
+			steps: []getFileStep{
+				{write: "large", want: "large"},
+				{want: "large"},
+				{want: "large"},
+				{write: "new", want: "new"},
+			},
+		},
+		{
+			name:   "neverCache",
+			policy: func(p cachePolicy) cachePolicy { p.NeverCache = true; p.LoadCount = 0; return p },
+			steps: []getFileStep{
+				{write: "v1", want: "v1"},
+				{write: "v2", want: "v2"},
+			},
+		},
+		{
+			name: "missing file",
+			steps: []getFileStep{
+				{wantErr: os.ErrNotExist},
+				{wantErr: os.ErrNotExist},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = tt.policy(p)
+			}
+			ns, dir := newTestNamespace(t, p)
+			ctx := context.Background()
+
+			for i, step := range tt.steps {
+				if step.write != "" {
+					err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(step.write), 0644)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				fr := newFileRequest(ns, "a.txt", nil)
+				data, err := getFile(ctx, fr)
+				if step.wantErr != nil {
+					if !errors.Is(err, step.wantErr) {
+						t.Fatalf("step %d: err = %v, want %v", i, err, step.wantErr)
+					}
+				} else if err != nil {
+					t.Fatalf("step %d: err = %v", i, err)
+				}
+				if string(data) != step.want {
+					t.Fatalf("step %d: data = %q, want %q", i, data, step.want)
+				}
+				cached, _ := store.HGet(ctx, fr.key, "data")
+				if (cached != "") != step.cached {
+					t.Fatalf("step %d: cached = %q, want cached %v", i, cached, step.cached)
+				}
+			}
+		})
+	}
+}
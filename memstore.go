@@ -0,0 +1,216 @@
+/*
+	此模块实现进程内的缓存仓库，数据保存在map中，
+	每个key可以设置存活时间，过期的key在访问时删除，另外后台会定时清理一次。
+	适合单节点部署以及没有redis的环境
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 进程内的一个hash
+type memEntry struct {
+	fields   map[string]string
+	expireAt time.Time // 零值代表永不过期
+}
+
+// 进程内的缓存仓库
+type memoryStore struct {
+	mu       chan bool
+	entries  map[string]*memEntry
+	onExpire func(key string, fields map[string]string)
+}
+
+// 创建进程内的缓存仓库，并启动定时清理
+func newMemoryStore() *memoryStore {
+	ms := new(memoryStore)
+	ms.entries = make(map[string]*memEntry)
+	ms.mu = make(chan bool, 1)
+	ms.mu <- true
+
+	go ms.sweep(time.Minute)
+
+	return ms
+}
+
+// 获取没有过期的key，调用方需要持有锁
+func (ms *memoryStore) get(key string) *memEntry {
+	entry, ok := ms.entries[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expireAt.IsZero() && time.Now().After(entry.expireAt) {
+		delete(ms.entries, key)
+		if _, ok := entry.fields["data"]; ok && ms.onExpire != nil {
+			go ms.onExpire(key, entry.fields)
+		}
+		return nil
+	}
+	return entry
+}
+
+// 定时删除过期的key，避免不再被访问的key一直占用内存
+func (ms *memoryStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		<-ms.mu
+		for key := range ms.entries {
+			ms.get(key)
+		}
+		ms.mu <- true
+	}
+}
+
+func (ms *memoryStore) Available(key string) error {
+	return nil
+}
+
+func (ms *memoryStore) Exists(ctx context.Context, key string) (bool, error) {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	return ms.get(key) != nil, nil
+}
+
+func (ms *memoryStore) HGet(ctx context.Context, key string, field string) (string, error) {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	entry := ms.get(key)
+	if entry == nil {
+		return "", errCacheMiss
+	}
+	value, ok := entry.fields[field]
+	if !ok {
+		return "", errCacheMiss
+	}
+	return value, nil
+}
+
+func (ms *memoryStore) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	fields := make(map[string]string)
+	if entry := ms.get(key); entry != nil {
+		for field, value := range entry.fields {
+			fields[field] = value
+		}
+	}
+	return fields, nil
+}
+
+func (ms *memoryStore) HSet(ctx context.Context, key string, values map[string]interface{}) error {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	entry := ms.get(key)
+	if entry == nil {
+		entry = &memEntry{fields: make(map[string]string, len(values))}
+		ms.entries[key] = entry
+	}
+	for field, value := range values {
+		entry.fields[field] = toString(value)
+	}
+	return nil
+}
+
+func (ms *memoryStore) HIncrBy(ctx context.Context, key string, field string, n int64) (int64, error) {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	entry := ms.get(key)
+	if entry == nil {
+		entry = &memEntry{fields: make(map[string]string)}
+		ms.entries[key] = entry
+	}
+	// 与redis一样，字段不存在时从0开始
+	var old int64
+	if value, ok := entry.fields[field]; ok {
+		var err error
+		old, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("hash value is not an integer: %w", err)
+		}
+	}
+	entry.fields[field] = strconv.FormatInt(old+n, 10)
+	return old + n, nil
+}
+
+func (ms *memoryStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	entry := ms.get(key)
+	if entry == nil {
+		return nil
+	}
+	entry.expireAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (ms *memoryStore) ExpireFile(ctx context.Context, key string, ttl time.Duration) error {
+	return ms.Expire(ctx, key, ttl)
+}
+
+func (ms *memoryStore) Persist(ctx context.Context, key string) error {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	if entry := ms.get(key); entry != nil {
+		entry.expireAt = time.Time{}
+	}
+	return nil
+}
+
+func (ms *memoryStore) Del(ctx context.Context, keys ...string) error {
+	<-ms.mu
+	defer func() { ms.mu <- true }()
+	for _, key := range keys {
+		delete(ms.entries, key)
+	}
+	return nil
+}
+
+func (ms *memoryStore) OnExpire(fn func(key string, fields map[string]string)) {
+	<-ms.mu
+	ms.onExpire = fn
+	ms.mu <- true
+}
+
+func (ms *memoryStore) Scan(ctx context.Context, fn func(key string)) error {
+	<-ms.mu
+	keys := make([]string, 0, len(ms.entries))
+	for key := range ms.entries {
+		if strings.HasPrefix(key, "{") && strings.HasSuffix(key, "}") && ms.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	ms.mu <- true
+
+	// 回调中可能访问缓存仓库，不能持有锁
+	for _, key := range keys {
+		fn(key)
+	}
+	return nil
+}
+
+func (ms *memoryStore) TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	allowed, wait := fallbackLimiter.take(key, rate, burst)
+	return allowed, wait, nil
+}
+
+// 将字段的值转换为字符串，与redis保存的形式一致
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+	此模块实现虚拟命名空间，一个中间件实例可以同时服务多个产品。
+	每个命名空间有自己的源站目录、默认后缀、缓存策略(loadCount/extendCount/ttl/hotttl)
+	以及缓存key的前缀，都在Serverconfig.json的namespaces中配置。
+	请求通过两种方式选择命名空间：
+	1. 路径 /download/{namespace}?file=
+	2. 请求的Host与命名空间配置的hosts匹配
+	都没有匹配时使用默认的命名空间，也就是配置文件顶层的prefix、suffix以及RDBConfig中的策略。
+	默认命名空间的key前缀为"/"，命名空间的名字不能包含"/"，所以不会与其他命名空间的key冲突
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 缓存策略
+type cachePolicy struct {
+	LoadCount   int           // 需要缓存的访问次数
+	ExtendCount int           // 需要延长存活时间的次数
+	TTL         time.Duration // 文件第一次缓存的存活时间
+	HotTTL      time.Duration // 热点数据的存活时间
+	MaxSize     int64         // 可以缓存的最大文件大小，单位为字节，0为不限制
+	NeverCache  bool          // 从不缓存
+}
+
+// 命名空间
+type namespace struct {
+	name      string
+	suffix    string // 默认的文件后缀
+	keyPrefix string // 缓存key的前缀，避免不同命名空间的同名文件冲突
+	policy    cachePolicy
+	origin    origin
+}
+
+var defaultNamespace *namespace          // 默认的命名空间
+var namespaces map[string]*namespace     // 按名字索引的命名空间
+var namespaceHosts map[string]*namespace // 按Host索引的命名空间
+
+const defaultKeyPrefix = "/" // 默认命名空间的key前缀
+
+// 根据配置创建所有命名空间
+func newNamespaces() error {
+
+	defaultOrigin, err := newOrigin(setting.Origin, setting.Prefix, setting.Roots)
+	if err != nil {
+		return err
+	}
+	defaultNamespace = &namespace{
+		suffix:    setting.Suffix,
+		keyPrefix: defaultKeyPrefix,
+		policy: cachePolicy{
+			LoadCount:   setting.LoadCount,
+			ExtendCount: setting.ExtendCount,
+			TTL:         time.Duration(setting.TTL) * time.Minute,
+			HotTTL:      time.Duration(setting.HotTTL) * time.Minute,
+		},
+		origin: defaultOrigin,
+	}
+
+	namespaces = make(map[string]*namespace, len(setting.Namespaces))
+	namespaceHosts = make(map[string]*namespace)
+	for _, nc := range setting.Namespaces {
+		if nc.Name == "" || strings.Contains(nc.Name, "/") {
+			return fmt.Errorf("invalid namespace name %q", nc.Name)
+		}
+		if _, ok := namespaces[nc.Name]; ok {
+			return fmt.Errorf("duplicate namespace %v", nc.Name)
+		}
+
+		// 没有单独配置源站时使用本地文件系统
+		originConfig := OriginConfig{Type: fileOriginType}
+		if nc.Origin != nil {
+			originConfig = *nc.Origin
+		}
+		o, err := newOrigin(originConfig, nc.Prefix, nc.Roots)
+		if err != nil {
+			return fmt.Errorf("namespace %v: %w", nc.Name, err)
+		}
+
+		ns := &namespace{
+			name:      nc.Name,
+			suffix:    nc.Suffix,
+			keyPrefix: nc.KeyPrefix,
+			policy:    defaultNamespace.policy,
+			origin:    o,
+		}
+		if ns.keyPrefix == "" {
+			ns.keyPrefix = nc.Name + "/"
+		}
+		if err = checkKeyPrefix(ns.keyPrefix); err != nil {
+			return fmt.Errorf("namespace %v: %w", nc.Name, err)
+		}
+		// 没有配置的策略沿用默认值
+		if nc.LoadCount > 0 {
+			ns.policy.LoadCount = nc.LoadCount
+		}
+		if nc.ExtendCount > 0 {
+			ns.policy.ExtendCount = nc.ExtendCount
+		}
+		if nc.TTL > 0 {
+			ns.policy.TTL = time.Duration(nc.TTL) * time.Minute
+		}
+		if nc.HotTTL > 0 {
+			ns.policy.HotTTL = time.Duration(nc.HotTTL) * time.Minute
+		}
+
+		namespaces[ns.name] = ns
+		for _, host := range nc.Hosts {
+			namespaceHosts[strings.ToLower(host)] = ns
+		}
+	}
+	return nil
+}
+
+// 检查key前缀，前缀不能是其他命名空间前缀的开头，否则根据key无法分辨文件属于哪个命名空间
+func checkKeyPrefix(prefix string) error {
+	if strings.HasPrefix(prefix, defaultKeyPrefix) {
+		return errors.New("keyPrefix can not start with " + defaultKeyPrefix)
+	}
+	for _, ns := range namespaces {
+		if strings.HasPrefix(prefix, ns.keyPrefix) || strings.HasPrefix(ns.keyPrefix, prefix) {
+			return fmt.Errorf("keyPrefix %q overlaps namespace %v", prefix, ns.name)
+		}
+	}
+	return nil
+}
+
+// 返回所有命名空间，包括默认的命名空间
+func allNamespaces() []*namespace {
+	all := []*namespace{defaultNamespace}
+	for _, ns := range namespaces {
+		all = append(all, ns)
+	}
+	return all
+}
+
+// 根据名字查找命名空间，名字为空时返回默认的命名空间
+func namespaceByName(name string) (*namespace, bool) {
+	if name == "" {
+		return defaultNamespace, true
+	}
+	ns, ok := namespaces[name]
+	return ns, ok
+}
+
+// 根据请求的路径或者Host选择命名空间，路径中的命名空间不存在时返回false
+func resolveNamespace(r *http.Request) (*namespace, bool) {
+
+	// /download/{namespace}
+	if name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/download"), "/"); name != "" {
+		ns, ok := namespaces[name]
+		return ns, ok
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ns, ok := namespaceHosts[strings.ToLower(host)]; ok {
+		return ns, true
+	}
+	return defaultNamespace, true
+}
@@ -0,0 +1,174 @@
+/*
+	此模块实现文件不存在时的负缓存。
+	爬虫经常请求随机的文件名，每次都要打开硬盘上的文件并且记录一条错误日志，
+	所以源站返回文件不存在之后会记住这个结果negativeTTL秒：
+	1. 进程内记录一份，同一个文件再次请求时不访问缓存仓库也不访问源站
+	2. 缓存仓库中记录一份(key为文件的key加上:miss)，其他中间件实例也能用到
+	3. 文件出现之后(例如固定、上传了这个文件)调用forget删除负缓存
+	文件不存在不再逐条记录到错误日志，而是每隔missLogInterval秒汇总记录一次
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const missSuffix = ":miss" // 负缓存的key的后缀
+
+// 负缓存
+type negativeCache struct {
+	ttl     time.Duration
+	mu      chan bool
+	entries map[string]time.Time // 文件的key到过期时间的映射
+	misses  map[string]int       // 这段时间内不存在的文件以及请求次数
+}
+
+var negative *negativeCache // 全局的负缓存
+
+// 创建负缓存，ttl为0时只汇总日志，不缓存结果
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	nc := new(negativeCache)
+	nc.ttl = ttl
+	nc.entries = make(map[string]time.Time)
+	nc.misses = make(map[string]int)
+	nc.mu = make(chan bool, 1)
+	nc.mu <- true
+	return nc
+}
+
+// 文件是否在负缓存中
+func (nc *negativeCache) has(ctx context.Context, fr *fileRequest) bool {
+	if nc.ttl <= 0 {
+		return false
+	}
+
+	<-nc.mu
+	expireAt, ok := nc.entries[fr.key]
+	if ok && time.Now().After(expireAt) {
+		delete(nc.entries, fr.key)
+		ok = false
+	}
+	nc.mu <- true
+	if ok {
+		return true
+	}
+
+	// 进程内没有时再查缓存仓库，可能是其他实例记录的
+	if store.Available(fr.key) != nil {
+		return false
+	}
+	exist, err := store.Exists(ctx, fr.key+missSuffix)
+	if err != nil || !exist {
+		return false
+	}
+	nc.remember(fr.key)
+	return true
+}
+
+// 在进程内记录文件不存在
+func (nc *negativeCache) remember(key string) {
+	<-nc.mu
+	// 随机文件名太多时直接清空，避免占用过多内存
+	if len(nc.entries) > 100000 {
+		nc.entries = make(map[string]time.Time)
+	}
+	nc.entries[key] = time.Now().Add(nc.ttl)
+	nc.mu <- true
+}
+
+// 记录文件不存在
+func (nc *negativeCache) add(ctx context.Context, fr *fileRequest) {
+	if nc.ttl <= 0 {
+		return
+	}
+	nc.remember(fr.key)
+
+	if store.Available(fr.key) != nil {
+		return
+	}
+	key := fr.key + missSuffix
+	err := store.HSet(ctx, key, map[string]interface{}{"miss": 1})
+	if err == nil {
+		err = store.Expire(ctx, key, nc.ttl)
+	}
+	if err != nil {
+		go myLog.doLog(errorType, "negativeCache.add() err:"+err.Error())
+	}
+}
+
+// 文件已经出现，删除负缓存
+func (nc *negativeCache) forget(ctx context.Context, key string) {
+	if nc.ttl <= 0 {
+		return
+	}
+	<-nc.mu
+	delete(nc.entries, key)
+	nc.mu <- true
+
+	if store.Available(key) != nil {
+		return
+	}
+	err := store.Del(ctx, key+missSuffix)
+	if err != nil {
+		go myLog.doLog(errorType, "negativeCache.forget() err:"+err.Error())
+	}
+}
+
+// 记录一次不存在的文件的请求，定时汇总到错误日志
+func (nc *negativeCache) recordMiss(fr *fileRequest) {
+	<-nc.mu
+	if len(nc.misses) < 10000 {
+		nc.misses[fr.ns.keyPrefix+fr.name]++
+	} else {
+		nc.misses["..."]++
+	}
+	nc.mu <- true
+}
+
+// 每隔一段时间把不存在的文件汇总记录到错误日志，请求次数最多的文件排在前面
+func (nc *negativeCache) report(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		<-nc.mu
+		misses := nc.misses
+		nc.misses = make(map[string]int)
+		nc.mu <- true
+		if len(misses) == 0 {
+			continue
+		}
+
+		names := make([]string, 0, len(misses))
+		total := 0
+		for name, n := range misses {
+			names = append(names, name)
+			total += n
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return misses[names[i]] > misses[names[j]]
+		})
+		if len(names) > 10 {
+			names = names[:10]
+		}
+		top := make([]string, 0, len(names))
+		for _, name := range names {
+			top = append(top, fmt.Sprintf("%v(%v)", name, misses[name]))
+		}
+		myLog.doLog(errorType, fmt.Sprintf("%v requests for %v missing files in %v, top: %v",
+			total, len(misses), interval, strings.Join(top, ", ")))
+	}
+}
+
+// 记录获取文件的错误，文件不存在已经由负缓存汇总记录
+func logOriginErr(fn string, err error) {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, errOriginBusy) {
+		return
+	}
+	go myLog.doLog(errorType, fn+" err:"+err.Error())
+}
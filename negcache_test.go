@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNegativeCache(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 2, TTL: time.Minute})
+	negative = newNegativeCache(time.Minute)
+	ctx := context.Background()
+
+	fetch := func() error {
+		_, err := fetchOrigin(ctx, newFileRequest(ns, "a.txt", nil))
+		return err
+	}
+
+	if err := fetch(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+	// 文件出现之后仍然返回不存在，直到负缓存过期或者被删除
+	writeTestFile(t, dir, "v1")
+	if err := fetch(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("negative cached file: err = %v", err)
+	}
+
+	// 其他实例通过缓存仓库也能用到负缓存
+	other := newNegativeCache(time.Minute)
+	if !other.has(ctx, newFileRequest(ns, "a.txt", nil)) {
+		t.Fatal("negative cache entry is not shared through the store")
+	}
+
+	negative.forget(ctx, newFileRequest(ns, "a.txt", nil).key)
+	if err := fetch(); err != nil {
+		t.Fatalf("after forget: err = %v", err)
+	}
+	if other.has(ctx, newFileRequest(ns, "b.txt", nil)) {
+		t.Fatal("file that was never requested is negative cached")
+	}
+}
+
+func TestNegativeCacheExpires(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 2, TTL: time.Minute})
+	negative = newNegativeCache(50 * time.Millisecond)
+	ctx := context.Background()
+
+	if _, err := fetchOrigin(ctx, newFileRequest(ns, "a.txt", nil)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+	writeTestFile(t, dir, "v1")
+	time.Sleep(100 * time.Millisecond)
+	if _, err := fetchOrigin(ctx, newFileRequest(ns, "a.txt", nil)); err != nil {
+		t.Fatalf("after negativeTTL: err = %v", err)
+	}
+}
+
+// negativeTTL为0时不缓存结果，只汇总日志
+func TestNegativeCacheDisabled(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 2, TTL: time.Minute})
+	ctx := context.Background()
+
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := fetchOrigin(ctx, fr); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+	writeTestFile(t, dir, "v1")
+	if _, err := fetchOrigin(ctx, newFileRequest(ns, "a.txt", nil)); err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if negative.misses[ns.keyPrefix+"a.txt"] != 1 {
+		t.Fatalf("misses = %v", negative.misses)
+	}
+}
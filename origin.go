@@ -0,0 +1,308 @@
+/*
+	此模块定义源站的接口，缓存没有命中时从源站获取文件。目前有两种源站：
+	file      本地文件系统，文件在Prefix目录下，可以配置多个副本目录，见roots.go
+	http      上游的HTTP服务器，请求地址为url+文件名，
+	          会转发配置中指定的请求头，遵守上游返回的Cache-Control和ETag，
+	          上游返回404时视为文件不存在，返回5xx时视为源站不可用。
+	          缓存的key只有文件名，转发了请求头的响应可能因人而异，只有上游返回public或者s-maxage时才缓存。
+	          中间件自己的凭证(X-API-Key、X-Admin-Token，启用认证时的Authorization)不会转发
+	s3        S3兼容的对象存储，见s3origin.go
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileOriginType = "file"
+	httpOriginType = "http"
+)
+
+var (
+	errOriginUnavailable = errors.New("origin unavailable")
+	errNotModified       = errors.New("not modified")
+)
+
+// 从源站获取到的文件
+type originObject struct {
+	Data         []byte
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	MaxAge       time.Duration // 上游允许缓存的时间，0为没有限制
+	NoStore      bool          // 上游不允许缓存
+}
+
+// 条件请求的验证器，都为空时不做条件请求
+type validators struct {
+	etag         string    // 缓存的ETag，作为If-None-Match
+	lastModified time.Time // 缓存的修改时间，作为If-Modified-Since
+}
+
+// 是否需要做条件请求
+func (v validators) conditional() bool {
+	return v.etag != "" || !v.lastModified.IsZero()
+}
+
+// 给请求加上条件请求头
+func (v validators) setHeaders(header http.Header) {
+	if v.etag != "" {
+		header.Set("If-None-Match", v.etag)
+	}
+	if !v.lastModified.IsZero() {
+		header.Set("If-Modified-Since", v.lastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// 源站
+type origin interface {
+	// 获取文件，header为客户端的请求头，cond不为空时做条件请求
+	// 文件不存在时返回的错误满足errors.Is(err, os.ErrNotExist)，
+	// 条件请求时文件没有变化返回errNotModified
+	Fetch(ctx context.Context, name string, header http.Header, cond validators) (*originObject, error)
+}
+
+// 根据配置创建源站，prefix和roots只用于本地文件系统源站
+func newOrigin(cfg OriginConfig, prefix string, roots []string) (origin, error) {
+	switch cfg.Type {
+	case "", fileOriginType:
+		return newLocalOrigin(prefix, roots)
+	case httpOriginType:
+		return newHTTPOrigin(cfg)
+	case s3OriginType:
+		return newS3Origin(cfg)
+	default:
+		return nil, fmt.Errorf("unknown origin type %v", cfg.Type)
+	}
+}
+
+// HTTP上游源站
+type httpOrigin struct {
+	base    *url.URL
+	client  *http.Client
+	forward []string // 需要转发给上游的请求头
+}
+
+func newHTTPOrigin(cfg OriginConfig) (*httpOrigin, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	ho := new(httpOrigin)
+	ho.base = base
+	for _, h := range cfg.ForwardHeaders {
+		if isCredentialHeader(h) {
+			continue
+		}
+		ho.forward = append(ho.forward, h)
+	}
+	ho.client = &http.Client{
+		Timeout: time.Duration(cfg.Timeout) * time.Millisecond,
+	}
+	return ho, nil
+}
+
+// 是否是中间件自己的凭证，这些请求头不能转发给上游
+func isCredentialHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "X-Api-Key", "X-Admin-Token":
+		return true
+	case "Authorization":
+		return setting.Auth.Enable
+	}
+	return false
+}
+
+func (ho *httpOrigin) Fetch(ctx context.Context, name string, header http.Header, cond validators) (*originObject, error) {
+
+	target := ho.base.JoinPath(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	forwarded := false
+	for _, h := range ho.forward {
+		for _, v := range header.Values(h) {
+			req.Header.Add(h, v)
+			forwarded = true
+		}
+	}
+	cond.setHeaders(req.Header)
+
+	resp, err := ho.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOriginUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, errNotModified
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, fmt.Errorf("%w: %v returned %v", os.ErrNotExist, target, resp.Status)
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: %v returned %v", errOriginUnavailable, target, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("origin %v returned %v", target, resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOriginUnavailable, err)
+	}
+
+	obj := &originObject{
+		Data:        data,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.LastModified = lm
+	}
+	var shared bool
+	obj.MaxAge, obj.NoStore, shared = parseCacheControl(resp.Header.Get("Cache-Control"))
+	// 响应可能与转发的请求头有关，上游没有明确允许共享缓存时不缓存
+	if forwarded && !shared {
+		obj.NoStore = true
+	}
+	return obj, nil
+}
+
+// 解析Cache-Control，返回允许缓存的时间、是否禁止缓存以及上游是否允许共享缓存(public或者s-maxage)
+func parseCacheControl(value string) (maxAge time.Duration, noStore bool, shared bool) {
+	sharedMaxAge := -1
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.ToLower(strings.TrimSpace(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			noStore = true
+		case "public":
+			shared = true
+		case "max-age":
+			if n, err := strconv.Atoi(arg); err == nil && sharedMaxAge == -1 {
+				maxAge = time.Duration(n) * time.Second
+				noStore = noStore || n <= 0
+			}
+		case "s-maxage":
+			// s-maxage是给共享缓存的，优先级高于max-age
+			if n, err := strconv.Atoi(arg); err == nil {
+				sharedMaxAge = n
+				shared = true
+				maxAge = time.Duration(n) * time.Second
+				noStore = noStore || n <= 0
+			}
+		}
+	}
+	return maxAge, noStore, shared
+}
+
+// 一次文件请求，获取文件的过程中会记录源站返回的元数据
+type fileRequest struct {
+	ns     *namespace  // 文件所在的命名空间
+	name   string      // 文件名
+	key    string      // 文件在缓存中的key
+	header http.Header // 客户端的请求头
+	policy cachePolicy // 文件使用的缓存策略
+
+	contentType string
+	etag        string
+	maxAge      time.Duration
+	noStore     bool
+	// 源站文件的修改时间，与大小、内容的hash一起保存在缓存中，用来发现源站的文件变化
+	lastModified time.Time
+
+	storedAt         time.Time // 文件写入缓存的时间，从缓存返回时才有
+	stale            bool      // 从缓存返回的文件已经过期
+	revalidateFailed bool      // 上一次重新加载过期的文件失败
+}
+
+// 创建一次文件请求，缓存key带有命名空间的前缀
+func newFileRequest(ns *namespace, name string, header http.Header) *fileRequest {
+	return &fileRequest{
+		ns:     ns,
+		name:   name,
+		key:    fileKey(ns.keyPrefix + name),
+		header: header,
+		policy: applyRules(ns.policy, name),
+	}
+}
+
+// 整理客户端请求的文件名，文件名中有..或者空字符时返回false，避免读到源站目录之外的文件
+func cleanFileName(name string) (string, bool) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return "", false
+	}
+	for _, part := range strings.Split(strings.ReplaceAll(name, "\\", "/"), "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	clean := path.Clean("/" + name)[1:]
+	return clean, clean != ""
+}
+
+// 文件是否可以缓存，上游不允许、规则禁止或者超过大小限制时都不能缓存
+func (fr *fileRequest) cacheable(size int) bool {
+	if fr.noStore || fr.policy.NeverCache {
+		return false
+	}
+	return fr.policy.MaxSize <= 0 || int64(size) <= fr.policy.MaxSize
+}
+
+// 根据上游允许缓存的时间调整ttl
+func (fr *fileRequest) ttl(d time.Duration) time.Duration {
+	if fr.maxAge > 0 && fr.maxAge < d {
+		return fr.maxAge
+	}
+	return d
+}
+
+// 从源站获取文件，并记录源站返回的元数据
+func fetchOrigin(ctx context.Context, fr *fileRequest) ([]byte, error) {
+	return fetchOriginIfChanged(ctx, fr, validators{})
+}
+
+// 从源站获取文件，cond不为空时做条件请求，文件没有变化时返回errNotModified
+func fetchOriginIfChanged(ctx context.Context, fr *fileRequest, cond validators) ([]byte, error) {
+	// 最近确认过不存在的文件不再访问源站
+	if negative.has(ctx, fr) {
+		negative.recordMiss(fr)
+		return nil, fmt.Errorf("%w: %v (negative cache)", os.ErrNotExist, fr.name)
+	}
+
+	// 同时读取源站的请求太多时排队，排不上时放弃
+	if err := originSlots.acquire(ctx); err != nil {
+		return nil, err
+	}
+	obj, err := fr.ns.origin.Fetch(ctx, fr.name, fr.header, cond)
+	originSlots.release()
+	if errors.Is(err, os.ErrNotExist) {
+		negative.add(ctx, fr)
+		negative.recordMiss(fr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fr.contentType = obj.ContentType
+	fr.etag = obj.ETag
+	fr.maxAge = obj.MaxAge
+	fr.noStore = obj.NoStore
+	fr.lastModified = obj.LastModified
+	return obj.Data, nil
+}
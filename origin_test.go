@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"/dir//a.txt", "dir/a.txt", true},
+		{"./a.txt", "a.txt", true},
+		{"", "", false},
+		{"/", "", false},
+		{"../setting/Serverconfig.json", "", false},
+		{"dir/../../a.txt", "", false},
+		{"dir\\..\\a.txt", "", false},
+		{"a.txt\x00", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanFileName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanFileName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHTTPOriginForwardedHeaders(t *testing.T) {
+	var got http.Header
+	cacheControl := ""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	oldAuth := setting.Auth
+	defer func() { setting.Auth = oldAuth }()
+	setting.Auth.Enable = true
+
+	ho, err := newHTTPOrigin(OriginConfig{URL: upstream.URL, ForwardHeaders: []string{"Accept-Language", "Authorization", "X-API-Key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		cacheControl string
+		wantNoStore  bool
+	}{
+		{"no forwarded header", http.Header{}, "max-age=60", false},
+		{"forwarded header", http.Header{"Accept-Language": {"zh-CN"}}, "max-age=60", true},
+		{"forwarded header with public", http.Header{"Accept-Language": {"zh-CN"}}, "public, max-age=60", false},
+		{"forwarded header with s-maxage", http.Header{"Accept-Language": {"zh-CN"}}, "s-maxage=60", false},
+		// 中间件自己的凭证没有转发，响应可以缓存
+		{"credentials only", http.Header{"Authorization": {"Bearer secret"}, "X-Api-Key": {"secret"}}, "max-age=60", false},
+	}
+	for _, tt := range tests {
+		cacheControl = tt.cacheControl
+		obj, err := ho.Fetch(context.Background(), "a.txt", tt.header, validators{})
+		if err != nil {
+			t.Fatalf("%v: Fetch() err = %v", tt.name, err)
+		}
+		if obj.NoStore != tt.wantNoStore {
+			t.Errorf("%v: NoStore = %v, want %v", tt.name, obj.NoStore, tt.wantNoStore)
+		}
+		if got.Get("Authorization") != "" || got.Get("X-API-Key") != "" {
+			t.Errorf("%v: credentials forwarded to upstream: %v", tt.name, got)
+		}
+		if got.Get("Accept-Language") != tt.header.Get("Accept-Language") {
+			t.Errorf("%v: Accept-Language = %q", tt.name, got.Get("Accept-Language"))
+		}
+	}
+}
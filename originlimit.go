@@ -0,0 +1,94 @@
+/*
+	此模块限制同时读取源站的请求数量。
+	大量冷文件同时被请求时，每个请求都去打开、读取源站的文件，磁盘的延迟会变得很高，所有请求都变慢。
+	读取源站之前需要先拿到一个名额，名额用完时请求排队等待，等待超过queueTimeout毫秒，
+	或者排队的请求已经达到queueSize时不再等待，直接返回503和Retry-After，让客户端稍后再试，
+	保证拿到名额的请求仍然能够很快地完成
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var errOriginBusy = errors.New("origin busy")
+
+// 读取源站的名额
+type originLimiter struct {
+	slots   chan bool    // 名额，缓冲区的大小为同时读取的最大数量
+	waiting atomic.Int64 // 正在排队的请求数量
+	shed    atomic.Int64 // 上次统计之后被拒绝的请求数量
+}
+
+var originSlots *originLimiter
+
+// 根据配置创建名额，maxConcurrent不大于0时不限制，返回nil
+func newOriginLimiter(maxConcurrent int) *originLimiter {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &originLimiter{slots: make(chan bool, maxConcurrent)}
+}
+
+// 拿到一个名额，拿不到时返回errOriginBusy，请求被取消时返回ctx的错误
+func (ol *originLimiter) acquire(ctx context.Context) error {
+	if ol == nil {
+		return nil
+	}
+
+	// 有空闲的名额时不需要排队
+	select {
+	case ol.slots <- true:
+		return nil
+	default:
+	}
+
+	cfg := setting.OriginConcurrency
+	if ol.waiting.Add(1) > int64(cfg.QueueSize) {
+		ol.waiting.Add(-1)
+		ol.shed.Add(1)
+		return fmt.Errorf("%w: queue is full", errOriginBusy)
+	}
+	defer ol.waiting.Add(-1)
+
+	timer := time.NewTimer(time.Duration(cfg.QueueTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case ol.slots <- true:
+		return nil
+	case <-timer.C:
+		ol.shed.Add(1)
+		return fmt.Errorf("%w: queued more than %vms", errOriginBusy, cfg.QueueTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 归还名额
+func (ol *originLimiter) release() {
+	if ol == nil {
+		return
+	}
+	<-ol.slots
+}
+
+// 返回上次统计之后被拒绝的请求数量，并重新开始统计
+func (ol *originLimiter) shedCount() int64 {
+	if ol == nil {
+		return 0
+	}
+	return ol.shed.Swap(0)
+}
+
+// 返回503时建议客户端等待的秒数
+func originRetryAfter() int {
+	if setting.OriginConcurrency.RetryAfter > 0 {
+		return setting.OriginConcurrency.RetryAfter
+	}
+	return 1
+}
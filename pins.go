@@ -0,0 +1,199 @@
+/*
+	此模块实现固定缓存(pin)的文件。
+	有些文件(例如首页的视频)无论访问次数多少都必须从缓存返回，
+	管理员可以通过/admin/pins固定这些文件：
+	1. 固定时立即从源站加载文件到缓存中，并且去掉key的存活时间
+	2. 固定的文件不参与loadCount、extendCount的判断，setTTL也不会给它设置存活时间
+	3. 固定的文件记录在pinFile中，重启后重新加载到缓存
+	取消固定后key恢复命名空间的ttl，之后按正常的缓存策略处理
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// 一个固定的文件
+type pinEntry struct {
+	Namespace string    `json:"namespace"` // 命名空间的名字，默认命名空间为空
+	File      string    `json:"file"`      // 文件名
+	PinnedAt  time.Time `json:"pinnedAt"`  // 固定的时间
+}
+
+// 所有固定的文件
+type pinSet struct {
+	file string // 保存固定文件的路径，为空时不保存
+	mu   chan bool
+	pins map[string]pinEntry // 缓存key到固定文件的映射
+}
+
+var pins *pinSet // 全局的固定文件集合
+
+// 创建固定文件集合，并从pinFile中恢复之前固定的文件
+func newPinSet(file string) (*pinSet, error) {
+	ps := new(pinSet)
+	ps.file = file
+	ps.pins = make(map[string]pinEntry)
+	ps.mu = make(chan bool, 1)
+	ps.mu <- true
+
+	if file == "" {
+		return ps, nil
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []pinEntry
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		ns, ok := namespaceByName(entry.Namespace)
+		if !ok {
+			// 命名空间已经从配置中删除，忽略这个文件
+			continue
+		}
+		ps.pins[fileKey(ns.keyPrefix+entry.File)] = entry
+	}
+	return ps, nil
+}
+
+// key是否被固定
+func (ps *pinSet) has(key string) bool {
+	if ps == nil {
+		return false
+	}
+	<-ps.mu
+	_, ok := ps.pins[key]
+	ps.mu <- true
+	return ok
+}
+
+// 返回所有固定的文件，按命名空间和文件名排序
+func (ps *pinSet) list() []pinEntry {
+	<-ps.mu
+	entries := make([]pinEntry, 0, len(ps.pins))
+	for _, entry := range ps.pins {
+		entries = append(entries, entry)
+	}
+	ps.mu <- true
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Namespace != entries[j].Namespace {
+			return entries[i].Namespace < entries[j].Namespace
+		}
+		return entries[i].File < entries[j].File
+	})
+	return entries
+}
+
+// 固定文件，立即从源站加载到缓存中
+func (ps *pinSet) pin(ctx context.Context, fr *fileRequest) error {
+	err := loadPinnedFile(ctx, fr)
+	if err != nil {
+		return err
+	}
+
+	<-ps.mu
+	ps.pins[fr.key] = pinEntry{Namespace: fr.ns.name, File: fr.name, PinnedAt: time.Now()}
+	err = ps.save()
+	ps.mu <- true
+	return err
+}
+
+// 取消固定，key恢复命名空间的ttl，返回文件之前是否被固定
+func (ps *pinSet) unpin(ctx context.Context, fr *fileRequest) (bool, error) {
+	<-ps.mu
+	_, ok := ps.pins[fr.key]
+	delete(ps.pins, fr.key)
+	err := ps.save()
+	ps.mu <- true
+	if !ok || err != nil {
+		return ok, err
+	}
+	return true, extendFile(ctx, fr, fr.policy.TTL)
+}
+
+// 将固定的文件写入pinFile，先写临时文件再重命名，调用方需要持有锁
+func (ps *pinSet) save() error {
+	if ps.file == "" {
+		return nil
+	}
+	entries := make([]pinEntry, 0, len(ps.pins))
+	for _, entry := range ps.pins {
+		entries = append(entries, entry)
+	}
+	content, err := json.MarshalIndent(entries, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(ps.file), ".pins-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ps.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// 重启后把固定的文件重新加载到缓存中，缓存中已经存在的文件只去掉存活时间
+func (ps *pinSet) restore() {
+	for _, entry := range ps.list() {
+		ns, ok := namespaceByName(entry.Namespace)
+		if !ok {
+			continue
+		}
+		fr := newFileRequest(ns, entry.File, nil)
+		err := loadPinnedFile(context.Background(), fr)
+		if err != nil {
+			go myLog.doLog(errorType, "pinSet.restore() "+entry.File+" err:"+err.Error())
+		}
+	}
+}
+
+// 从源站加载固定的文件到缓存中，并去掉key的存活时间
+func loadPinnedFile(ctx context.Context, fr *fileRequest) error {
+	err := store.Available(fr.key)
+	if err != nil {
+		return err
+	}
+	// 管理员确认文件存在，不使用之前的负缓存
+	negative.forget(ctx, fr.key)
+	data, err := fetchOrigin(ctx, fr)
+	if err != nil {
+		return err
+	}
+	fields := versionFields(fr, data)
+	fields["data"] = data
+	fields["type"] = fr.contentType
+	fields["etag"] = fr.etag
+	fields["maxage"] = int64(fr.maxAge / time.Second)
+	fields["fresh"] = 0
+	fields["stored"] = time.Now().Unix()
+	err = store.HSet(ctx, fr.key, fields)
+	if err != nil {
+		return err
+	}
+	return store.Persist(ctx, fr.key)
+}
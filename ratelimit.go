@@ -0,0 +1,167 @@
+/*
+	此模块实现按客户端的限流，使用令牌桶算法：
+	每个客户端在每个路由上有一个桶，桶里最多burst个令牌，每秒补充rate个，每个请求消耗一个令牌，
+	没有令牌时返回429，Retry-After为等到下一个令牌的秒数。被限流的请求不会进入处理函数，
+	所以也不会增加文件的访问次数，一个客户端不能靠刷请求把别人的热点数据挤出缓存。
+	客户端有凭证(API key、JWT)时按凭证的身份区分，否则按IP区分。
+	桶保存在缓存仓库中，使用redis时通过lua脚本原子地取令牌，多个实例共享同一个桶；
+	redis不可用时退化为进程内的桶，限流仍然有效，只是每个实例单独计算
+*/
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 进程内的令牌桶
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// 进程内的限流器，memory缓存仓库以及redis不可用时使用
+type localLimiter struct {
+	mu      chan bool
+	buckets map[string]*tokenBucket
+}
+
+var fallbackLimiter = newLocalLimiter()
+
+func newLocalLimiter() *localLimiter {
+	ll := &localLimiter{mu: make(chan bool, 1), buckets: make(map[string]*tokenBucket)}
+	ll.mu <- true
+	return ll
+}
+
+// 从桶里取一个令牌，取不到时返回需要等待的时间
+func (ll *localLimiter) take(key string, rate float64, burst int) (bool, time.Duration) {
+	<-ll.mu
+	defer func() { ll.mu <- true }()
+
+	now := time.Now()
+	// 客户端太多时清空，清空只会让客户端多拿到一些令牌
+	if len(ll.buckets) > 100000 {
+		ll.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := ll.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		ll.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// 返回路由的限流配置
+func rateLimitFor(route string) (RateLimitRoute, bool) {
+	for _, rl := range setting.RateLimit.Routes {
+		if rl.Path == route && rl.Rate > 0 {
+			if rl.Burst < 1 {
+				rl.Burst = 1
+			}
+			return rl, true
+		}
+	}
+	return RateLimitRoute{}, false
+}
+
+// 返回区分客户端的标识，有凭证时使用凭证的身份，否则使用IP
+func clientID(r *http.Request) string {
+	if name := principalName(r); name != "anonymous" {
+		return name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// 给处理函数加上限流，route为配置中的路由
+func limitRate(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rl, ok := rateLimitFor(route)
+		if !setting.RateLimit.Enable || !ok {
+			next(w, r)
+			return
+		}
+
+		key := "ratelimit:" + route + ":" + clientID(r)
+		allowed, wait, err := store.TakeToken(r.Context(), key, rl.Rate, rl.Burst)
+		if err != nil {
+			// redis不可用时使用进程内的桶
+			allowed, wait = fallbackLimiter.take(key, rl.Rate, rl.Burst)
+		}
+		if !allowed {
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// 注册路由的处理函数，同时加上限流，/download/这样的子路由与/download共用配置
+func handleLimited(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	route := pattern
+	if route != "/" {
+		route = strings.TrimSuffix(route, "/")
+	}
+	mux.HandleFunc(pattern, limitRate(route, handler))
+}
+
+// 在redis中原子地取令牌，桶的状态为hash(tokens, ts)，时间使用中间件的时间，单位为毫秒
+const takeTokenScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or burst
+local ts = tonumber(bucket[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+	ts = now
+end
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ts)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, wait}
+`
+
+// 取令牌需要的参数
+func takeTokenArgs(rate float64, burst int) []interface{} {
+	return []interface{}{rate, burst, time.Now().UnixMilli()}
+}
+
+// 解析lua脚本的结果
+func parseTakeToken(result interface{}) (bool, time.Duration) {
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		return true, 0
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalLimiterBurst(t *testing.T) {
+	ll := newLocalLimiter()
+
+	// 桶一开始是满的，可以连续取burst个令牌
+	for i := 0; i < 3; i++ {
+		if ok, _ := ll.take("a", 1, 3); !ok {
+			t.Fatalf("take %d: denied", i)
+		}
+	}
+	ok, wait := ll.take("a", 1, 3)
+	if ok {
+		t.Fatal("take after burst: allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Fatalf("wait = %v, want (0, 1s]", wait)
+	}
+
+	// 不同的客户端使用各自的桶
+	if ok, _ := ll.take("b", 1, 3); !ok {
+		t.Fatal("other key: denied")
+	}
+}
+
+func TestLocalLimiterRefill(t *testing.T) {
+	ll := newLocalLimiter()
+
+	if ok, _ := ll.take("a", 100, 1); !ok {
+		t.Fatal("first take: denied")
+	}
+	ok, wait := ll.take("a", 100, 1)
+	if ok {
+		t.Fatal("second take: allowed")
+	}
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _ := ll.take("a", 100, 1); !ok {
+		t.Fatal("take after refill: denied")
+	}
+}
+
+// 令牌不会超过burst，空闲很久之后也只能连续取burst个
+func TestLocalLimiterCap(t *testing.T) {
+	ll := newLocalLimiter()
+	ll.take("a", 1000, 2)
+	time.Sleep(20 * time.Millisecond)
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if ok, _ := ll.take("a", 1000, 2); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Fatalf("allowed = %d, want 2", allowed)
+	}
+}
+
+func TestParseTakeToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   interface{}
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{"allowed", []interface{}{int64(1), int64(0)}, true, 0},
+		{"denied", []interface{}{int64(0), int64(250)}, false, 250 * time.Millisecond},
+		// 脚本的结果无法解析时放行，不能因为限流器出错拒绝所有请求
+		{"unexpected type", "OK", true, 0},
+		{"wrong length", []interface{}{int64(0)}, true, 0},
+	}
+	for _, tt := range tests {
+		ok, wait := parseTakeToken(tt.result)
+		if ok != tt.wantOK || wait != tt.wantWait {
+			t.Errorf("%v: parseTakeToken() = %v, %v, want %v, %v", tt.name, ok, wait, tt.wantOK, tt.wantWait)
+		}
+	}
+}
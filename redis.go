@@ -0,0 +1,162 @@
+/*
+	此模块负责创建redis客户端，支持三种部署方式：
+	单机      配置rdpIp与rdpPort即可
+	哨兵      配置masterName与sentinelAddrs，由哨兵找到当前的主节点
+	集群      配置clusterAddrs，填写若干个种子节点即可
+	三种方式都返回redis.UniversalClient，缓存相关的代码不需要关心具体的部署方式
+	密码可以写在配置文件、单独的文件或者环境变量中，支持ACL用户名和TLS
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	standaloneMode = "standalone"
+	sentinelMode   = "sentinel"
+	clusterMode    = "cluster"
+)
+
+// 根据配置文件创建redis客户端
+func newRedisClient() (redis.UniversalClient, error) {
+
+	password, err := redisPassword()
+	if err != nil {
+		return nil, err
+	}
+	sentinelPassword, err := loadSecret(setting.SentinelPasswordEnv, setting.SentinelPasswordFile, setting.SentinelPassword)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := redisTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opt := &redis.UniversalOptions{
+		Username:  setting.UserName,
+		Password:  password,
+		DB:        setting.DB, // 默认DB 0
+		TLSConfig: tlsConfig,
+
+		PoolSize:     setting.PoolSize,     //最大连接数
+		MinIdleConns: setting.MinIdleConns, //最小空闲连接数
+		MaxIdleConns: setting.MaxIdleConns, //最大空闲连接数
+
+		PoolTimeout: time.Duration(setting.PoolTimeout) * time.Second, //等待连接最长时间，这里设置为5s
+
+		ContextTimeoutEnabled: true, // 让每个操作遵守context的截止时间
+	}
+
+	switch getRedisMode() {
+	case clusterMode:
+		// 集群模式下只能使用0号数据库，DB参数会被忽略
+		opt.Addrs = setting.ClusterAddrs
+		return redis.NewClusterClient(opt.Cluster()), nil
+	case sentinelMode:
+		opt.Addrs = setting.SentinelAddrs
+		opt.MasterName = setting.MasterName
+		opt.SentinelPassword = sentinelPassword
+		return redis.NewFailoverClient(opt.Failover()), nil
+	default:
+		opt.Addrs = []string{setting.RdbIp + setting.RdpPort}
+		return redis.NewClient(opt.Simple()), nil
+	}
+}
+
+// 获取redis的密码
+// 优先使用环境变量，其次是密码文件，最后是配置文件中的password，这样密码可以不写在RDBConfig.json中
+func redisPassword() (string, error) {
+	return loadSecret(setting.PassWordEnv, setting.PassWordFile, setting.PassWord)
+}
+
+// 按环境变量、文件、配置文件中的值的顺序读取密码，哨兵和分片的密码也使用这个顺序
+func loadSecret(env string, file string, value string) (string, error) {
+	if env != "" {
+		if secret, ok := os.LookupEnv(env); ok {
+			return secret, nil
+		}
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		// 去掉文件末尾的换行
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// 根据配置创建TLS配置，没有启用TLS时返回nil
+func redisTLSConfig() (*tls.Config, error) {
+	if !setting.TLS.Enable {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         setting.TLS.ServerName,
+		InsecureSkipVerify: setting.TLS.InsecureSkipVerify,
+	}
+
+	// 使用自定义的CA验证服务端证书
+	if setting.TLS.CAFile != "" {
+		pem, err := os.ReadFile(setting.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + setting.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// 双向认证时需要客户端证书
+	if setting.TLS.CertFile != "" || setting.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(setting.TLS.CertFile, setting.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// 获取redis的部署方式，没有显式配置mode时根据填写的地址推断
+func getRedisMode() string {
+	switch setting.Mode {
+	case standaloneMode, sentinelMode, clusterMode:
+		return setting.Mode
+	}
+	if len(setting.ClusterAddrs) > 0 {
+		return clusterMode
+	}
+	if setting.MasterName != "" {
+		return sentinelMode
+	}
+	return standaloneMode
+}
+
+// 返回文件在redis中的key
+// 文件名被包在hash tag里，集群模式下同一个文件相关的所有key都会落在同一个slot上，
+// 单机和哨兵模式下hash tag没有特殊含义，所以三种部署方式使用同样的key
+func fileKey(fileName string) string {
+	return "{" + fileName + "}"
+}
+
+// 返回与文件相关的其他key，例如元数据，与fileKey处于同一个slot
+func relatedKey(fileName string, name string) string {
+	return fileKey(fileName) + ":" + name
+}
@@ -0,0 +1,231 @@
+/*
+	此模块实现本地文件系统源站，文件可以在多个目录(例如两个挂载点)中保存副本。
+	读取文件时按配置的顺序尝试每个目录，以下情况会换到下一个目录：
+	1. 目录中没有这个文件
+	2. 读取时出现I/O错误
+	3. 读取超过rootTimeout，NFS卡住时open也可能一直阻塞，所以读取在单独的协程中进行
+	后台会定时检查每个目录，不可用的目录在恢复之前会被跳过。每次换目录都会记录到错误日志
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// 一个存放文件的目录
+type originRoot struct {
+	path    string
+	healthy atomic.Bool
+}
+
+// 文件在目录中的路径，目录末尾有没有/都可以，与上传、删除、列表使用的路径一致
+func (root *originRoot) file(name string) string {
+	return filepath.Join(root.path, name)
+}
+
+// 本地文件系统源站
+type localOrigin struct {
+	roots []*originRoot
+}
+
+// 创建本地文件系统源站，没有配置roots时只使用prefix
+// 目录为空时文件名会相对于进程的工作目录，返回错误
+func newLocalOrigin(prefix string, paths []string) (*localOrigin, error) {
+	if len(paths) == 0 {
+		paths = []string{prefix}
+	}
+
+	lo := new(localOrigin)
+	for _, path := range paths {
+		if path == "" {
+			return nil, errors.New("empty origin root, set prefix or roots")
+		}
+		root := &originRoot{path: path}
+		root.healthy.Store(true)
+		lo.roots = append(lo.roots, root)
+	}
+	return lo, nil
+}
+
+// 从一个目录读取文件的结果
+type rootResult struct {
+	data    []byte
+	modTime time.Time
+	err     error
+}
+
+func (lo *localOrigin) Fetch(ctx context.Context, name string, header http.Header, cond validators) (*originObject, error) {
+
+	// 本地文件没有ETag，修改时间没有变化时不需要读取
+	if !cond.lastModified.IsZero() {
+		if info, err := lo.stat(name); err == nil && info.ModTime().Equal(cond.lastModified) {
+			return nil, errNotModified
+		}
+	}
+
+	// 所有目录都不可用时仍然逐个尝试，总比直接失败好
+	roots := lo.healthyRoots()
+	if len(roots) == 0 {
+		roots = lo.roots
+	}
+
+	var lastErr error
+	var failovers []string
+	for i, root := range roots {
+		data, modTime, err := root.read(ctx, name)
+		if err == nil {
+			logFailovers(failovers)
+			return &originObject{Data: data, LastModified: modTime}, nil
+		}
+		// 请求已经被取消，不需要再尝试其他目录
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// 文件不存在的错误优先返回，这样所有目录都没有文件时返回404
+		if lastErr == nil || errors.Is(err, os.ErrNotExist) {
+			lastErr = err
+		}
+		if i+1 < len(roots) {
+			failovers = append(failovers, "origin failover "+root.path+" -> "+roots[i+1].path+" for "+name+":"+err.Error())
+		}
+	}
+	// 所有目录都没有这个文件时不记录切换，由负缓存汇总记录
+	if !errors.Is(lastErr, os.ErrNotExist) {
+		logFailovers(failovers)
+	}
+	return nil, lastErr
+}
+
+// 记录切换目录的日志
+func logFailovers(failovers []string) {
+	for _, failover := range failovers {
+		go myLog.doLog(errorType, failover)
+	}
+}
+
+// 返回可用的目录
+func (lo *localOrigin) healthyRoots() []*originRoot {
+	roots := make([]*originRoot, 0, len(lo.roots))
+	for _, root := range lo.roots {
+		if root.healthy.Load() {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// 从目录中读取文件以及文件的修改时间，超过rootTimeout时放弃
+func (root *originRoot) read(ctx context.Context, name string) ([]byte, time.Time, error) {
+	rctx, cancel := withMillisecond(ctx, setting.RootTimeout)
+	defer cancel()
+
+	result := make(chan rootResult, 1)
+	go func() {
+		// 先取修改时间再读取，读取过程中文件被修改时记录的是旧的修改时间，之后还能发现变化
+		var modTime time.Time
+		if info, err := os.Stat(root.file(name)); err == nil {
+			modTime = info.ModTime()
+		}
+		data, err := getFileStream(rctx, root.file(name))
+		result <- rootResult{data, modTime, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.data, r.modTime, r.err
+	case <-rctx.Done():
+		return nil, time.Time{}, fmt.Errorf("read %v: %w", root.file(name), rctx.Err())
+	}
+}
+
+// 返回写入文件的目录，也就是第一个可用的目录
+func (lo *localOrigin) writableRoot() *originRoot {
+	if roots := lo.healthyRoots(); len(roots) > 0 {
+		return roots[0]
+	}
+	return lo.roots[0]
+}
+
+// 在可用的目录中按顺序查找文件，返回第一个找到的文件的信息
+func (lo *localOrigin) stat(name string) (os.FileInfo, error) {
+	roots := lo.healthyRoots()
+	if len(roots) == 0 {
+		roots = lo.roots
+	}
+	var lastErr error
+	for _, root := range roots {
+		info, err := os.Stat(root.file(name))
+		if err == nil {
+			return info, nil
+		}
+		if lastErr == nil || errors.Is(err, os.ErrNotExist) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// 定时检查每个目录是否可用，状态发生变化时记录到错误日志
+func (lo *localOrigin) healthCheck() {
+
+	interval := time.Duration(setting.RootCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for _, root := range lo.roots {
+			err := root.check(interval)
+			healthy := err == nil
+			if root.healthy.Swap(healthy) == healthy {
+				continue
+			}
+			if healthy {
+				myLog.doLog(errorType, "origin root "+root.path+" is up again")
+			} else {
+				myLog.doLog(errorType, "origin root "+root.path+" is down:"+err.Error())
+			}
+		}
+	}
+}
+
+// 检查目录是否可以访问，卡住的挂载点会在超时后视为不可用
+func (root *originRoot) check(timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		info, err := os.Stat(root.path)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%v is not a directory", root.path)
+		}
+		// 只读取一个目录项，确认挂载点可以读取，目录很大时也不会太慢
+		if err == nil {
+			var dir *os.File
+			dir, err = os.Open(root.path)
+			if err == nil {
+				_, err = dir.Readdirnames(1)
+				dir.Close()
+			}
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %v: timeout", root.path)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalOriginFetch(t *testing.T) {
+	r1, r2 := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(r1, "a.txt"), []byte("r1"), 0644)
+	os.MkdirAll(filepath.Join(r2, "dir"), 0755)
+	os.WriteFile(filepath.Join(r2, "dir", "b.txt"), []byte("r2"), 0644)
+
+	// 第一个目录末尾没有/，第二个有
+	lo, err := newLocalOrigin("", []string{r1, r2 + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr error
+	}{
+		{"a.txt", "r1", nil},
+		{"dir/b.txt", "r2", nil},
+		{"missing.txt", "", os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		obj, err := lo.Fetch(context.Background(), tt.name, nil, validators{})
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Fetch(%q) err = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || string(obj.Data) != tt.want {
+			t.Errorf("Fetch(%q) = %v, %v, want %q", tt.name, obj, err, tt.want)
+			continue
+		}
+		// 修改时间没有变化时不需要读取
+		if _, err = lo.Fetch(context.Background(), tt.name, nil, validators{lastModified: obj.LastModified}); !errors.Is(err, errNotModified) {
+			t.Errorf("conditional Fetch(%q) err = %v, want %v", tt.name, err, errNotModified)
+		}
+	}
+}
+
+func TestNewLocalOriginEmptyRoot(t *testing.T) {
+	if _, err := newLocalOrigin("", nil); err == nil {
+		t.Error("empty prefix without roots: no error")
+	}
+	if _, err := newLocalOrigin("./file/", []string{t.TempDir(), ""}); err == nil {
+		t.Error("empty root: no error")
+	}
+}
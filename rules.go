@@ -0,0 +1,90 @@
+/*
+	此模块实现按路径和类型匹配的缓存规则。
+	规则在Serverconfig.json的rules中按顺序配置，文件使用第一条匹配的规则，
+	一条规则可以按路径的glob、文件后缀或者MineType中的类型匹配，同时配置多个条件时都要满足。
+	规则可以覆盖命名空间的缓存策略(为0时沿用)、限制可缓存的文件大小，
+	或者把文件标记为never(从不缓存)、always(第一次访问就缓存)，例如：
+	{"suffix": "m3u8", "cache": "never"}
+	{"mimeType": "font/*", "cache": "always", "ttl": 1440}
+*/
+
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	neverCache  = "never"
+	alwaysCache = "always"
+)
+
+// 根据规则调整文件的缓存策略
+func applyRules(policy cachePolicy, name string) cachePolicy {
+	rule, ok := matchRule(name)
+	if !ok {
+		return policy
+	}
+
+	if rule.LoadCount > 0 {
+		policy.LoadCount = rule.LoadCount
+	}
+	if rule.ExtendCount > 0 {
+		policy.ExtendCount = rule.ExtendCount
+	}
+	if rule.TTL > 0 {
+		policy.TTL = time.Duration(rule.TTL) * time.Minute
+	}
+	if rule.HotTTL > 0 {
+		policy.HotTTL = time.Duration(rule.HotTTL) * time.Minute
+	}
+	if rule.MaxSize > 0 {
+		policy.MaxSize = int64(rule.MaxSize) << 10
+	}
+	switch rule.Cache {
+	case neverCache:
+		policy.NeverCache = true
+	case alwaysCache:
+		// 访问次数为0时第一次访问就缓存
+		policy.LoadCount = 0
+	}
+	return policy
+}
+
+// 返回第一条匹配文件的规则
+func matchRule(name string) (CacheRule, bool) {
+	suffix := getFileSuffix(name)
+	mimeType, _ := setting.MineType[suffix].(string)
+
+	for _, rule := range setting.Rules {
+		if rule.Path == "" && rule.Suffix == "" && rule.MimeType == "" {
+			continue
+		}
+		if rule.Path != "" {
+			if ok, _ := path.Match(rule.Path, name); !ok {
+				continue
+			}
+		}
+		if rule.Suffix != "" && !strings.EqualFold(strings.TrimPrefix(rule.Suffix, "."), suffix) {
+			continue
+		}
+		if rule.MimeType != "" && !matchMimeType(rule.MimeType, mimeType) {
+			continue
+		}
+		return rule, true
+	}
+	return CacheRule{}, false
+}
+
+// 判断类型是否匹配，支持font/*这样的通配
+func matchMimeType(pattern string, mimeType string) bool {
+	if mimeType == "" {
+		return false
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == mimeType
+}
@@ -0,0 +1,246 @@
+/*
+	此模块实现S3兼容的对象存储源站，可以对接AWS S3、MinIO等。
+	文件名加上keyPrefix就是对象的key，使用SigV4签名的GetObject获取对象，
+	重新验证时GetObject带上If-None-Match和If-Modified-Since，对象没有变化时S3返回304，不会下载对象，
+	比先HeadObject再GetObject少一次请求。
+	endpoint、bucket和密钥都来自配置文件，密钥也可以通过环境变量或者文件提供，
+	默认使用path-style的地址(endpoint/bucket/key)，本地的MinIO不需要额外配置
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3OriginType = "s3"
+
+// 空请求体的sha256，GET和HEAD请求都使用这个值
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3兼容的对象存储源站
+type s3Origin struct {
+	endpoint     *url.URL
+	bucket       string
+	keyPrefix    string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+}
+
+func newS3Origin(originConfig OriginConfig) (*s3Origin, error) {
+	cfg := originConfig.S3
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %v", cfg.Endpoint)
+	}
+
+	so := new(s3Origin)
+	so.endpoint = endpoint
+	so.bucket = cfg.Bucket
+	so.keyPrefix = cfg.KeyPrefix
+	so.region = cfg.Region
+	if so.region == "" {
+		so.region = "us-east-1"
+	}
+	so.pathStyle = !cfg.VirtualHost
+	so.accessKey, err = loadSecret(cfg.AccessKeyEnv, cfg.AccessKeyFile, cfg.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+	so.secretKey, err = loadSecret(cfg.SecretKeyEnv, cfg.SecretKeyFile, cfg.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	so.sessionToken, err = loadSecret(cfg.SessionTokenEnv, cfg.SessionTokenFile, "")
+	if err != nil {
+		return nil, err
+	}
+	so.client = &http.Client{
+		Timeout: time.Duration(originConfig.Timeout) * time.Millisecond,
+	}
+	return so, nil
+}
+
+func (so *s3Origin) Fetch(ctx context.Context, name string, header http.Header, cond validators) (*originObject, error) {
+
+	// 条件请求时对象没有变化S3返回304，不需要下载
+	resp, err := so.do(ctx, http.MethodGet, name, cond)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOriginUnavailable, err)
+	}
+
+	obj := &originObject{
+		Data:        data,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.LastModified = lm
+	}
+	obj.MaxAge, obj.NoStore, _ = parseCacheControl(resp.Header.Get("Cache-Control"))
+	return obj, nil
+}
+
+// 发送签名后的请求，并把S3的错误状态码转换为源站的错误
+func (so *s3Origin) do(ctx context.Context, method string, name string, cond validators) (*http.Response, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, so.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	// 条件请求头不参与签名
+	cond.setHeaders(req.Header)
+	so.sign(req, time.Now().UTC())
+
+	resp, err := so.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errOriginUnavailable, err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, errNotModified
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: s3 object %v", os.ErrNotExist, so.keyPrefix+name)
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("%w: s3 returned %v", errOriginUnavailable, resp.Status)
+	default:
+		return nil, fmt.Errorf("s3 %v %v returned %v", method, so.keyPrefix+name, resp.Status)
+	}
+}
+
+// 返回对象的地址
+func (so *s3Origin) objectURL(name string) string {
+	u := *so.endpoint
+	key := so.keyPrefix + name
+	if so.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + so.bucket + "/" + key
+	} else {
+		u.Host = so.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	return u.String()
+}
+
+// 使用AWS Signature Version 4给请求签名
+func (so *s3Origin) sign(req *http.Request, now time.Time) {
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + so.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if so.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", so.sessionToken)
+	}
+
+	// 需要签名的请求头，名字为小写并按字典序排列
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+so.secretKey), date)
+	key = hmacSHA256(key, so.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+so.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// 按SigV4的规则编码路径，除了非保留字符和/以外都要编码
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// 按SigV4的规则生成查询字符串，参数按名字排序，空格编码为%20
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, strings.ReplaceAll(url.QueryEscape(k), "+", "%20")+"="+
+				strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,151 @@
+/*
+	此模块负责在客户端对多个独立的redis实例做分片，
+	不需要部署redis集群就可以把几台redis的内存合起来用。
+	每个文件的key通过rendezvous哈希落到某一个分片上，哈希使用的是分片的名字，
+	增加或者删除一个分片时只有属于这个分片的key会移动。
+	后台会定时ping每个分片，不可用的分片上的key不会转移到其他分片，
+	而是直接返回错误，由getFile从硬盘加载
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+	"github.com/redis/go-redis/v9"
+)
+
+var errShardDown = errors.New("redis shard is down")
+
+// 单个分片
+type shard struct {
+	name    string
+	client  *redis.Client
+	healthy atomic.Bool
+	breaker *circuitBreaker
+}
+
+// 所有分片的集合
+type shardSet struct {
+	shards map[string]*shard
+	hash   *rendezvous.Rendezvous
+}
+
+var shards *shardSet // 全局的分片集合，没有配置分片时为nil
+
+// 根据配置文件创建分片集合，每个分片使用自己的密码，ACL用户名和TLS配置是共用的
+func newShardSet() (*shardSet, error) {
+
+	tlsConfig, err := redisTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ss := new(shardSet)
+	ss.shards = make(map[string]*shard, len(setting.Shards))
+	names := make([]string, 0, len(setting.Shards))
+
+	for _, sc := range setting.Shards {
+		password, err := loadSecret(sc.PassWordEnv, sc.PassWordFile, sc.PassWord)
+		if err != nil {
+			return nil, err
+		}
+		s := new(shard)
+		s.name = sc.Name
+		s.client = redis.NewClient(&redis.Options{
+			Addr:      sc.Addr,
+			Username:  setting.UserName,
+			Password:  password,
+			DB:        sc.DB,
+			TLSConfig: tlsConfig,
+
+			PoolSize:     setting.PoolSize,
+			MinIdleConns: setting.MinIdleConns,
+			MaxIdleConns: setting.MaxIdleConns,
+
+			PoolTimeout: time.Duration(setting.PoolTimeout) * time.Second,
+
+			ContextTimeoutEnabled: true,
+		})
+		// 启动时先认为分片可用，由健康检查纠正
+		s.healthy.Store(true)
+		s.breaker = newCircuitBreaker("shard "+s.name, s.client)
+
+		ss.shards[s.name] = s
+		names = append(names, s.name)
+	}
+	ss.hash = rendezvous.New(names, xxhash.Sum64String)
+
+	return ss, nil
+}
+
+// 返回key所在的分片的客户端，分片不可用时返回errShardDown，熔断器打开时返回errBreakerOpen
+func (ss *shardSet) get(key string) (redis.UniversalClient, error) {
+	s := ss.shards[ss.hash.Lookup(hashTag(key))]
+	if !s.healthy.Load() {
+		return nil, fmt.Errorf("%w: %v", errShardDown, s.name)
+	}
+	if s.breaker.isOpen() {
+		return nil, fmt.Errorf("%w: %v", errBreakerOpen, s.name)
+	}
+	return s.client, nil
+}
+
+// 定时检查每个分片是否可用，状态发生变化时记录到错误日志
+func (ss *shardSet) healthCheck() {
+
+	interval := time.Duration(setting.ShardCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for _, s := range ss.shards {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := s.client.Ping(ctx).Err()
+			cancel()
+
+			healthy := err == nil
+			if s.healthy.Swap(healthy) == healthy {
+				continue
+			}
+			if healthy {
+				myLog.doLog(errorType, "shard "+s.name+" is up again")
+			} else {
+				myLog.doLog(errorType, "shard "+s.name+" is down:"+err.Error())
+			}
+		}
+	}
+}
+
+// 返回key对应的redis客户端，配置了分片时按key选择分片
+func getRDB(key string) (redis.UniversalClient, error) {
+	if shards != nil {
+		return shards.get(key)
+	}
+	if rdbBreaker.isOpen() {
+		return nil, errBreakerOpen
+	}
+	return rdb, nil
+}
+
+// 返回key中hash tag的部分，同一个文件相关的key会落在同一个分片上
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start == -1 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
@@ -0,0 +1,180 @@
+/*
+	此模块实现带签名、会过期的下载链接。
+	signedURL.require为true时/download必须带上签名参数：
+	expires    过期时间，unix秒
+	kid        签名使用的密钥id
+	ip         可选，链接只能由这个客户端地址使用
+	sig        HMAC-SHA256(密钥, 命名空间\n文件名\nexpires\nip)，base64url编码
+	签名无效或者已经过期时返回403。
+	signedURL.keys中可以配置多个密钥，第一个用来生成链接，所有的密钥都可以验证链接，
+	更换密钥时把新的密钥放在前面，等旧的链接都过期之后再删除旧的密钥。
+	生成链接可以使用管理接口/admin/sign?ns=&file=&ttl=&ip=，
+	或者命令行 ./caching-middleware sign -ns game -file hero.mp4 -ttl 3600 -ip 1.2.3.4
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	errSignatureMissing = errors.New("missing signature")
+	errSignatureInvalid = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+)
+
+var signKeys map[string][]byte // 签名密钥的id到密钥的映射
+
+// 启动时读取所有签名的密钥，密钥可以来自环境变量或者文件
+func loadSignKeys() (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(setting.SignedURL.Keys))
+	for _, key := range setting.SignedURL.Keys {
+		secret, err := loadSecret(key.SecretEnv, key.SecretFile, key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %v: %w", key.ID, err)
+		}
+		keys[key.ID] = []byte(secret)
+	}
+	return keys, nil
+}
+
+// 根据id查找签名的密钥
+func signKey(kid string) ([]byte, bool) {
+	secret, ok := signKeys[kid]
+	return secret, ok && len(secret) > 0
+}
+
+// 计算签名
+func urlSignature(secret []byte, nsName string, name string, expires int64, ip string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v", nsName, name, expires, ip)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 验证下载请求的签名，name为加上默认后缀之后的文件名
+func verifySignedURL(r *http.Request, ns *namespace, name string) error {
+	query := r.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" {
+		return errSignatureMissing
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	secret, ok := signKey(query.Get("kid"))
+	if !ok {
+		return errSignatureInvalid
+	}
+
+	ip := query.Get("ip")
+	expected := urlSignature(secret, ns.name, name, expires, ip)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errSignatureInvalid
+	}
+	if time.Now().Unix() > expires {
+		return errSignatureExpired
+	}
+	if ip != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if host != ip {
+			return errSignatureInvalid
+		}
+	}
+	return nil
+}
+
+// 生成带签名的下载链接，file为请求参数中的文件名(不带默认后缀)
+func mintSignedURL(nsName string, file string, ttl time.Duration, ip string) (string, error) {
+	ns, ok := namespaceByName(nsName)
+	if !ok {
+		return "", fmt.Errorf("unknown namespace %v", nsName)
+	}
+	if len(setting.SignedURL.Keys) == 0 {
+		return "", errors.New("no signing key configured")
+	}
+	kid := setting.SignedURL.Keys[0].ID
+	secret, ok := signKey(kid)
+	if !ok {
+		return "", fmt.Errorf("signing key %v is empty", kid)
+	}
+	if ttl <= 0 {
+		ttl = time.Duration(setting.SignedURL.DefaultTTL) * time.Second
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("file", file)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("kid", kid)
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	query.Set("sig", urlSignature(secret, ns.name, file+ns.suffix, expires, ip))
+
+	downloadPath := "/download"
+	if ns.name != "" {
+		downloadPath += "/" + ns.name
+	}
+	return setting.SignedURL.BaseURL + downloadPath + "?" + query.Encode(), nil
+}
+
+// 处理生成链接的管理接口
+func handleSign(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, adminScope) {
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("file") == "" {
+		http.Error(w, "missing file", http.StatusBadRequest)
+		return
+	}
+	ttl, _ := strconv.Atoi(query.Get("ttl"))
+	link, err := mintSignedURL(query.Get("ns"), query.Get("file"), time.Duration(ttl)*time.Second, query.Get("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"url": link})
+}
+
+// 是否以命令行的方式生成链接
+func isSignCommand() bool {
+	return len(os.Args) > 1 && os.Args[1] == "sign"
+}
+
+// 命令行生成链接
+func runSignCommand(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	nsName := fs.String("ns", "", "namespace, empty for the default namespace")
+	file := fs.String("file", "", "file name, without the default suffix of the namespace")
+	ttl := fs.Int("ttl", 0, "seconds before the link expires, 0 for signedURL.defaultTTL")
+	ip := fs.String("ip", "", "client address the link is bound to")
+	fs.Parse(args)
+
+	if *file == "" {
+		fmt.Println("err: missing -file")
+		os.Exit(2)
+	}
+	link, err := mintSignedURL(*nsName, *file, time.Duration(*ttl)*time.Second, *ip)
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+	fmt.Println(link)
+}
@@ -0,0 +1,199 @@
+/*
+	此模块实现过期文件的stale-while-revalidate和stale-if-error。
+	缓存中的文件有两个存活时间：
+	soft   文件第一次缓存的ttl(或者热点数据的hotttl)，超过之后文件变为过期
+	hard   soft加上staleTTL，超过之后key才真正从缓存中删除
+	过期的文件仍然从缓存返回，同时在后台从源站重新加载一次；源站出错时继续返回过期的文件，
+	直到超过hard。返回过期的文件时带上Age和Warning头：
+	110 Response is Stale          文件已经过期，正在后台重新加载
+	111 Revalidation Failed        上一次重新加载失败，源站可能不可用
+	staleTTL为0时不启用，文件在soft时就被删除
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 正在后台重新加载的文件，重新加载结束时关闭对应的channel
+var revalidating = struct {
+	mu   chan bool
+	keys map[string]chan struct{}
+}{mu: make(chan bool, 1), keys: make(map[string]chan struct{})}
+
+func init() {
+	revalidating.mu <- true
+}
+
+// 返回文件在缓存中的存活时间，soft之后还可以作为过期文件返回staleTTL
+func cacheTTL(soft time.Duration) time.Duration {
+	return soft + time.Duration(setting.StaleTTL)*time.Second
+}
+
+// 记录文件的soft过期时间以及缓存的时间，在loadFileToRedis中与文件一起写入
+func freshFields(soft time.Duration) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"fresh":  now.Add(soft).Unix(),
+		"stored": now.Unix(),
+		"reverr": 0,
+	}
+}
+
+// 重新设置缓存中文件的存活时间，soft过期时间一起更新，否则延长了ttl的热点数据在ttl之后就被当作过期文件
+func extendFile(ctx context.Context, fr *fileRequest, soft time.Duration) error {
+	err := store.HSet(ctx, fr.key, map[string]interface{}{"fresh": time.Now().Add(soft).Unix(), "reverr": 0})
+	if err != nil {
+		return err
+	}
+	return setFileTTL(ctx, fr.key, cacheTTL(soft))
+}
+
+// 文件是否已经超过了hard过期时间，key还在缓存中只是为了让过期回调读到文件，不能再返回给客户端
+func pastHardExpiry(fields map[string]string) bool {
+	fresh, err := strconv.ParseInt(fields["fresh"], 10, 64)
+	if err != nil || fresh == 0 {
+		return false
+	}
+	return time.Now().Unix() >= fresh+int64(setting.StaleTTL)
+}
+
+// 根据缓存中的字段判断文件是否过期，过期时在后台重新加载
+func checkStale(fr *fileRequest, fields map[string]string) {
+	if stored, err := strconv.ParseInt(fields["stored"], 10, 64); err == nil {
+		fr.storedAt = time.Unix(stored, 0)
+	}
+	fresh, err := strconv.ParseInt(fields["fresh"], 10, 64)
+	// 固定的文件没有soft过期时间
+	if err != nil || fresh == 0 || setting.StaleTTL <= 0 {
+		return
+	}
+	if time.Now().Unix() < fresh {
+		return
+	}
+	fr.stale = true
+	fr.revalidateFailed = fields["reverr"] == "1"
+	go revalidate(fr)
+}
+
+// 开始重新加载文件，已经有重新加载在进行时返回它的channel以及false
+func startRevalidate(key string) (chan struct{}, bool) {
+	<-revalidating.mu
+	defer func() { revalidating.mu <- true }()
+	if done, ok := revalidating.keys[key]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	revalidating.keys[key] = done
+	return done, true
+}
+
+// 重新加载结束，唤醒等待的调用方
+func finishRevalidate(key string, done chan struct{}) {
+	<-revalidating.mu
+	delete(revalidating.keys, key)
+	revalidating.mu <- true
+	close(done)
+}
+
+// 在后台从源站重新加载过期的文件，同一个文件同时只有一个重新加载
+func revalidate(stale *fileRequest) {
+	done, ok := startRevalidate(stale.key)
+	if !ok {
+		return
+	}
+	defer finishRevalidate(stale.key, done)
+
+	// 用缓存的ETag和修改时间做条件请求，源站的文件没有变化时不需要重新下载
+	reloadFile(stale, validators{etag: stale.etag, lastModified: stale.lastModified})
+}
+
+// 源站的文件已经变化，立即重新加载，返回时缓存中已经是新的文件。
+// 正在进行的重新加载可能读到的是变化之前的文件，等它结束之后再加载一次；
+// 等待之后又有新的重新加载开始的话，它读到的一定是变化之后的文件，等它结束即可
+func reloadChangedFile(fr *fileRequest) {
+	done, ok := startRevalidate(fr.key)
+	if !ok {
+		<-done
+		if done, ok = startRevalidate(fr.key); !ok {
+			<-done
+			return
+		}
+	}
+	defer finishRevalidate(fr.key, done)
+	reloadFile(fr, validators{})
+}
+
+// 从源站重新加载文件写入缓存，调用方需要先调用startRevalidate
+func reloadFile(stale *fileRequest, cond validators) {
+	// 客户端的请求结束之后仍然继续加载，使用单独的context
+	ctx, cancel := requestCtx(context.Background())
+	defer cancel()
+
+	// 不带客户端的请求头，后台的请求不能使用某个客户端的身份
+	fr := newFileRequest(stale.ns, stale.name, nil)
+	data, err := fetchOriginIfChanged(ctx, fr, cond)
+	switch {
+	case errors.Is(err, errNotModified):
+		// 文件没有变化，只更新验证的时间和soft过期时间
+		fr.maxAge = stale.maxAge
+		err = store.HSet(ctx, fr.key, map[string]interface{}{"stored": time.Now().Unix()})
+		if err == nil {
+			err = extendFile(ctx, fr, fr.ttl(fr.policy.TTL))
+		}
+		if err != nil {
+			go myLog.doLog(errorType, "reloadFile() err:"+err.Error())
+		}
+		return
+	case errors.Is(err, os.ErrNotExist):
+		// 源站已经删除了文件，不再返回过期的文件
+		err = store.Del(ctx, fr.key)
+		if err != nil {
+			go myLog.doLog(errorType, "reloadFile() err:"+err.Error())
+		}
+		return
+	case err != nil:
+		// 源站出错，继续返回过期的文件直到hard过期
+		go myLog.doLog(errorType, "reloadFile() "+fr.name+" err:"+err.Error())
+		err = store.HSet(ctx, fr.key, map[string]interface{}{"reverr": 1})
+		if err != nil {
+			go myLog.doLog(errorType, "reloadFile() err:"+err.Error())
+		}
+		return
+	}
+
+	if !fr.cacheable(len(data)) {
+		err = store.Del(ctx, fr.key)
+	} else {
+		err = loadFileToRedis(ctx, fr, data)
+	}
+	if err != nil {
+		go myLog.doLog(errorType, "reloadFile() err:"+err.Error())
+	}
+}
+
+// 设置从缓存返回的文件的Age和Warning头
+func setStaleHeaders(w http.ResponseWriter, fr *fileRequest) {
+	if fr.storedAt.IsZero() {
+		return
+	}
+	age := time.Since(fr.storedAt)
+	if age < 0 {
+		age = 0
+	}
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	if !fr.stale {
+		return
+	}
+	if fr.revalidateFailed {
+		w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+	} else {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 把缓存中文件的soft过期时间改到过去
+func expireSoft(t *testing.T, key string, ago time.Duration) {
+	t.Helper()
+	err := store.HSet(context.Background(), key, map[string]interface{}{"fresh": time.Now().Add(-ago).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 等待后台的重新加载完成
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 测试结束之前等待后台的重新加载结束，之后才能恢复全局变量
+func waitRevalidating(t *testing.T) {
+	t.Cleanup(func() {
+		waitFor(t, "background revalidation", func() bool {
+			<-revalidating.mu
+			defer func() { revalidating.mu <- true }()
+			return len(revalidating.keys) == 0
+		})
+	})
+}
+
+func enableStale(t *testing.T, staleTTL int) {
+	t.Helper()
+	old := setting.StaleTTL
+	t.Cleanup(func() { setting.StaleTTL = old })
+	setting.StaleTTL = staleTTL
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	enableStale(t, 60)
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	waitRevalidating(t)
+	ctx := context.Background()
+
+	writeTestFile(t, dir, "v1")
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有过期时不带Warning
+	fr = newFileRequest(ns, "a.txt", nil)
+	data, err := getFile(ctx, fr)
+	if err != nil || string(data) != "v1" || fr.stale {
+		t.Fatalf("fresh file: %q, %v, stale %v", data, err, fr.stale)
+	}
+
+	writeTestFile(t, dir, "v2 longer")
+	expireSoft(t, fr.key, time.Second)
+
+	// 过期的文件仍然从缓存返回，同时在后台重新加载
+	fr = newFileRequest(ns, "a.txt", nil)
+	data, err = getFile(ctx, fr)
+	if err != nil || string(data) != "v1" || !fr.stale {
+		t.Fatalf("stale file: %q, %v, stale %v", data, err, fr.stale)
+	}
+	w := httptest.NewRecorder()
+	setStaleHeaders(w, fr)
+	if got := w.Header().Get("Warning"); got != `110 - "Response is Stale"` {
+		t.Fatalf("Warning = %q", got)
+	}
+	if w.Header().Get("Age") == "" {
+		t.Fatal("no Age header")
+	}
+
+	waitFor(t, "revalidation", func() bool { return cachedData(t, fr.key) == "v2 longer" })
+	fr = newFileRequest(ns, "a.txt", nil)
+	if data, _ = getFile(ctx, fr); string(data) != "v2 longer" || fr.stale {
+		t.Fatalf("after revalidation: %q, stale %v", data, fr.stale)
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	enableStale(t, 60)
+	var failing atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("v1"))
+	}))
+	defer upstream.Close()
+
+	ns, _ := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	waitRevalidating(t)
+	ho, err := newHTTPOrigin(OriginConfig{URL: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.origin = ho
+	ctx := context.Background()
+
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err = getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	expireSoft(t, fr.key, time.Second)
+	if data, err := getFile(ctx, newFileRequest(ns, "a.txt", nil)); err != nil || string(data) != "v1" {
+		t.Fatalf("stale file: %q, %v", data, err)
+	}
+	waitFor(t, "failed revalidation", func() bool {
+		reverr, _ := store.HGet(ctx, fr.key, "reverr")
+		return reverr == "1"
+	})
+
+	// 源站出错时继续返回过期的文件，并说明重新加载失败
+	fr = newFileRequest(ns, "a.txt", nil)
+	data, err := getFile(ctx, fr)
+	if err != nil || string(data) != "v1" || !fr.revalidateFailed {
+		t.Fatalf("stale file after failed revalidation: %q, %v, revalidateFailed %v", data, err, fr.revalidateFailed)
+	}
+	w := httptest.NewRecorder()
+	setStaleHeaders(w, fr)
+	if got := w.Header().Get("Warning"); got != `111 - "Revalidation Failed"` {
+		t.Fatalf("Warning = %q", got)
+	}
+}
+
+// 超过hard过期时间的文件不能再返回，即使key还在缓存中
+func TestStalePastHardExpiry(t *testing.T) {
+	enableStale(t, 60)
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	waitRevalidating(t)
+	ctx := context.Background()
+
+	writeTestFile(t, dir, "v1")
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "v2")
+	expireSoft(t, fr.key, time.Duration(setting.StaleTTL+1)*time.Second)
+
+	if !pastHardExpiry(map[string]string{"fresh": strconv.FormatInt(time.Now().Add(-61*time.Second).Unix(), 10)}) {
+		t.Fatal("pastHardExpiry() = false")
+	}
+	data, err := getFile(ctx, newFileRequest(ns, "a.txt", nil))
+	if err != nil || string(data) != "v2" {
+		t.Fatalf("file past hard expiry: %q, %v, want v2 from origin", data, err)
+	}
+}
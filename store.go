@@ -0,0 +1,326 @@
+/*
+	此模块定义缓存仓库的接口，缓存相关的函数都通过全局的store访问缓存，
+	不直接使用redis客户端。目前有两种实现：
+	redis      使用redis(单机、哨兵、集群或者客户端分片)，多个中间件实例可以共享缓存
+	memory     缓存在进程内存中，支持ttl，适合单节点部署，不需要redis
+	接口的形式参照redis的hash操作，一个文件对应一个hash，data和access是其中的字段。
+	注册了过期回调之后，redis中每个保存了文件数据的key会多一个影子key，影子key按原来的ttl过期，
+	原来的key多存活expireGrace，这样收到影子key的过期通知时还能读到文件的内容。
+	负缓存、上传状态、只有访问次数的key没有影子key，按原来的ttl过期
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisStoreType  = "redis"
+	memoryStoreType = "memory"
+)
+
+const (
+	expireSuffix = ":expire"        // 影子key的后缀
+	expireGrace  = 30 * time.Second // 注册了过期回调时原来的key多存活的时间
+)
+
+// key或者字段不存在
+var errCacheMiss = errors.New("cache miss")
+
+// 缓存仓库
+type cacheStore interface {
+	// 缓存当前能否访问key，不能访问时getFile直接从硬盘加载
+	Available(key string) error
+	// key是否存在
+	Exists(ctx context.Context, key string) (bool, error)
+	// 获取hash的一个字段，key或者字段不存在时返回errCacheMiss
+	HGet(ctx context.Context, key string, field string) (string, error)
+	// 获取hash的所有字段，key不存在时返回空的map
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	// 设置hash的若干个字段
+	HSet(ctx context.Context, key string, values map[string]interface{}) error
+	// 给hash的一个字段加上n，返回相加后的值
+	HIncrBy(ctx context.Context, key string, field string, n int64) (int64, error)
+	// 设置key的存活时间
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// 设置保存了文件数据的key的存活时间，过期时会调用OnExpire注册的回调
+	ExpireFile(ctx context.Context, key string, ttl time.Duration) error
+	// 去掉key的存活时间，key永不过期
+	Persist(ctx context.Context, key string) error
+	// 删除key
+	Del(ctx context.Context, keys ...string) error
+	// 注册缓存中的文件过期时的回调，fields为过期前hash中的所有字段，包括文件内容和元数据
+	OnExpire(fn func(key string, fields map[string]string))
+	// 遍历缓存中所有文件的key，不包括影子key、负缓存这些相关的key
+	Scan(ctx context.Context, fn func(key string)) error
+	// 从令牌桶中取一个令牌，桶每秒补充rate个，最多burst个，取不到时返回需要等待的时间
+	TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+var store cacheStore // 全局的缓存仓库
+
+// 根据配置创建缓存仓库
+func newCacheStore() (cacheStore, error) {
+	if setting.Store == memoryStoreType {
+		return newMemoryStore(), nil
+	}
+
+	// 配置了多个独立的redis实例时在客户端分片，否则根据配置创建单机、哨兵或者集群的客户端
+	var err error
+	if len(setting.Shards) > 0 {
+		shards, err = newShardSet()
+	} else {
+		rdb, err = newRedisClient()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rdb != nil {
+		rdbBreaker = newCircuitBreaker(getRedisMode(), rdb)
+	}
+	return new(redisStore), nil
+}
+
+// 使用redis的缓存仓库，key所在的客户端由getRDB决定
+type redisStore struct {
+	onExpire func(key string, fields map[string]string)
+}
+
+func (rs *redisStore) Available(key string) error {
+	_, err := getRDB(key)
+	return err
+}
+
+func (rs *redisStore) Exists(ctx context.Context, key string) (bool, error) {
+	client, err := getRDB(key)
+	if err != nil {
+		return false, err
+	}
+	rctx, cancel := redisReadCtx(ctx)
+	defer cancel()
+	n, err := client.Exists(rctx, key).Result()
+	return n == 1, err
+}
+
+func (rs *redisStore) HGet(ctx context.Context, key string, field string) (string, error) {
+	client, err := getRDB(key)
+	if err != nil {
+		return "", err
+	}
+	rctx, cancel := redisReadCtx(ctx)
+	defer cancel()
+	value, err := client.HGet(rctx, key, field).Result()
+	if err == redis.Nil {
+		return "", errCacheMiss
+	}
+	return value, err
+}
+
+func (rs *redisStore) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	client, err := getRDB(key)
+	if err != nil {
+		return nil, err
+	}
+	// hash中有文件的数据
+	rctx, cancel := redisBulkCtx(ctx)
+	defer cancel()
+	return client.HGetAll(rctx, key).Result()
+}
+
+func (rs *redisStore) HSet(ctx context.Context, key string, values map[string]interface{}) error {
+	client, err := getRDB(key)
+	if err != nil {
+		return err
+	}
+	// 写入文件的数据时不使用单个写操作的截止时间
+	ctxFn := redisWriteCtx
+	if _, ok := values["data"]; ok {
+		ctxFn = redisBulkCtx
+	}
+	wctx, cancel := ctxFn(ctx)
+	defer cancel()
+	return client.HSet(wctx, key, values).Err()
+}
+
+func (rs *redisStore) HIncrBy(ctx context.Context, key string, field string, n int64) (int64, error) {
+	client, err := getRDB(key)
+	if err != nil {
+		return 0, err
+	}
+	wctx, cancel := redisWriteCtx(ctx)
+	defer cancel()
+	return client.HIncrBy(wctx, key, field, n).Result()
+}
+
+func (rs *redisStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	client, err := getRDB(key)
+	if err != nil {
+		return err
+	}
+	wctx, cancel := redisWriteCtx(ctx)
+	defer cancel()
+	return client.Expire(wctx, key, ttl).Err()
+}
+
+func (rs *redisStore) ExpireFile(ctx context.Context, key string, ttl time.Duration) error {
+	if rs.onExpire == nil {
+		return rs.Expire(ctx, key, ttl)
+	}
+	client, err := getRDB(key)
+	if err != nil {
+		return err
+	}
+	wctx, cancel := redisWriteCtx(ctx)
+	defer cancel()
+
+	// 影子key按原来的ttl过期，原来的key多存活一段时间，过期回调中还能读到文件
+	err = client.Expire(wctx, key, ttl+expireGrace).Err()
+	if err != nil {
+		return err
+	}
+	return client.Set(wctx, key+expireSuffix, 1, ttl).Err()
+}
+
+func (rs *redisStore) Persist(ctx context.Context, key string) error {
+	client, err := getRDB(key)
+	if err != nil {
+		return err
+	}
+	wctx, cancel := redisWriteCtx(ctx)
+	defer cancel()
+	err = client.Persist(wctx, key).Err()
+	if err != nil {
+		return err
+	}
+	// 影子key过期时会触发过期回调，一起删除
+	return client.Del(wctx, key+expireSuffix).Err()
+}
+
+func (rs *redisStore) Del(ctx context.Context, keys ...string) error {
+	// 不同的key可能在不同的分片上，逐个删除
+	for _, key := range keys {
+		client, err := getRDB(key)
+		if err != nil {
+			return err
+		}
+		wctx, cancel := redisWriteCtx(ctx)
+		err = client.Del(wctx, key, key+expireSuffix).Err()
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisStore) OnExpire(fn func(key string, fields map[string]string)) {
+	rs.onExpire = fn
+
+	// 过期通知只会发给key所在的节点，需要订阅每一个节点
+	switch {
+	case shards != nil:
+		for _, s := range shards.shards {
+			go rs.listenExpired(s.client)
+		}
+	default:
+		if cluster, ok := rdb.(*redis.ClusterClient); ok {
+			err := cluster.ForEachMaster(context.Background(), func(ctx context.Context, client *redis.Client) error {
+				go rs.listenExpired(client)
+				return nil
+			})
+			if err != nil {
+				go myLog.doLog(errorType, "redisStore.OnExpire() err:"+err.Error())
+			}
+			return
+		}
+		go rs.listenExpired(rdb)
+	}
+}
+
+func (rs *redisStore) Scan(ctx context.Context, fn func(key string)) error {
+	// 文件的key为{文件名}，相关的key在后面还有后缀
+	scan := func(ctx context.Context, client redis.UniversalClient) error {
+		iter := client.Scan(ctx, 0, "{*}", 1000).Iterator()
+		for iter.Next(ctx) {
+			fn(iter.Val())
+		}
+		return iter.Err()
+	}
+
+	// 每个分片或者集群的每个主节点都要遍历
+	switch {
+	case shards != nil:
+		for _, s := range shards.shards {
+			if !s.healthy.Load() {
+				continue
+			}
+			if err := scan(ctx, s.client); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		if rdbBreaker != nil && rdbBreaker.isOpen() {
+			return errBreakerOpen
+		}
+		if cluster, ok := rdb.(*redis.ClusterClient); ok {
+			return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+				return scan(ctx, client)
+			})
+		}
+		return scan(ctx, rdb)
+	}
+}
+
+var takeToken = redis.NewScript(takeTokenScript)
+
+func (rs *redisStore) TakeToken(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	client, err := getRDB(key)
+	if err != nil {
+		return false, 0, err
+	}
+	wctx, cancel := redisWriteCtx(ctx)
+	defer cancel()
+	result, err := takeToken.Run(wctx, client, []string{key}, takeTokenArgs(rate, burst)...).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	allowed, wait := parseTakeToken(result)
+	return allowed, wait, nil
+}
+
+// 订阅一个节点的过期通知，影子key过期时读取原来的key中的文件并调用回调
+func (rs *redisStore) listenExpired(client redis.UniversalClient) {
+	ctx := context.Background()
+
+	// 打开过期通知，托管的redis可能禁止CONFIG命令，这时需要在redis的配置中加上notify-keyspace-events Ex
+	flags, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err == nil {
+		err = client.ConfigSet(ctx, "notify-keyspace-events", flags["notify-keyspace-events"]+"Ex").Err()
+	}
+	if err != nil {
+		go myLog.doLog(errorType, "listenExpired() enable notification err:"+err.Error())
+	}
+
+	pubsub := client.PSubscribe(ctx, "__keyevent@*__:expired")
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		if !strings.HasSuffix(msg.Payload, expireSuffix) {
+			continue
+		}
+		key := strings.TrimSuffix(msg.Payload, expireSuffix)
+		fields, err := rs.HGetAll(ctx, key)
+		if err != nil || fields["data"] == "" {
+			// 已经被删除或者没有缓存文件的key
+			continue
+		}
+		rs.onExpire(key, fields)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+	此模块负责给请求、redis操作和硬盘操作设置截止时间，
+	所有的截止时间都从请求的context派生，请求被取消时相关的操作也会停止
+*/
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// 返回整个下载请求的context
+func requestCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withMillisecond(ctx, setting.RequestTimeout)
+}
+
+// 返回单个redis读操作的context
+func redisReadCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withMillisecond(ctx, setting.ReadTimeout)
+}
+
+// 返回单个redis写操作的context
+func redisWriteCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withMillisecond(ctx, setting.WriteTimeout)
+}
+
+// 返回读写整个文件的redis操作的context，文件可能有几MB，
+// 不使用单个操作的截止时间，只受请求的截止时间限制，避免大文件的正常读写被当作超时而触发熔断
+func redisBulkCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithCancel(ctx)
+}
+
+// 返回读取一个文件的context
+func diskReadCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withMillisecond(ctx, setting.DiskReadTimeout)
+}
+
+// 给context设置以毫秒为单位的超时时间，小于等于0时不设置
+func withMillisecond(ctx context.Context, ms int) (context.Context, context.CancelFunc) {
+	if ms <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(ms)*time.Millisecond)
+}
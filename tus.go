@@ -0,0 +1,405 @@
+/*
+	此模块实现tus 1.0的断点续传上传(https://tus.io/protocols/resumable-upload)，
+	支持core以及creation、termination、expiration扩展，需要管理接口的令牌：
+	OPTIONS /tus/        返回服务器支持的版本和扩展
+	POST    /tus/        创建上传，Upload-Length为文件大小，
+	                     Upload-Metadata中的filename为文件名，ns为命名空间(可以不填)
+	HEAD    /tus/{id}    返回已经上传的大小Upload-Offset
+	PATCH   /tus/{id}    从Upload-Offset开始追加数据，连接断开时已经收到的数据也会保存
+	DELETE  /tus/{id}    取消上传
+	上传的状态保存在缓存仓库中(key为tus:{id})，没有完成的数据保存在tus.dir中，
+	数据全部收到之后写入命名空间的源站目录，与/upload一样会让旧的缓存失效。
+	超过tus.expire小时没有继续上传的上传会过期，后台定时删除过期的数据
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusKeyPrefix  = "tus:"
+)
+
+// 正在追加数据的上传，同一个上传同时只能有一个PATCH
+var tusLocks = struct {
+	mu  chan bool
+	ids map[string]bool
+}{mu: make(chan bool, 1), ids: make(map[string]bool)}
+
+func init() {
+	tusLocks.mu <- true
+}
+
+// 一个上传的状态
+type tusUpload struct {
+	id     string
+	ns     string
+	file   string
+	length int64
+	offset int64
+}
+
+// 上传没有继续时的过期时间
+func tusExpire() time.Duration {
+	if setting.Tus.Expire <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(setting.Tus.Expire) * time.Hour
+}
+
+// 没有完成的数据的路径
+func tusDataPath(id string) string {
+	return filepath.Join(setting.Tus.Dir, id)
+}
+
+// 处理tus请求
+func handleTus(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, adminScope) {
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tus"), "/")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		if setting.Upload.MaxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(int64(setting.Upload.MaxSize)<<20, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		tusCreate(w, r)
+	case id != "" && r.Method == http.MethodHead:
+		tusHead(w, r, id)
+	case id != "" && r.Method == http.MethodPatch:
+		tusPatch(w, r, id)
+	case id != "" && r.Method == http.MethodDelete:
+		tusDelete(w, r, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// 解析Upload-Metadata，格式为"key base64(value),key base64(value)"
+func parseTusMetadata(value string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// 创建上传
+func tusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	_, _, name, ok := uploadTarget(w, metadata["ns"], metadata["filename"], length)
+	if !ok {
+		return
+	}
+
+	buf := make([]byte, 16)
+	if _, err = rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upload := &tusUpload{id: hex.EncodeToString(buf), ns: metadata["ns"], file: name, length: length}
+
+	err = os.MkdirAll(setting.Tus.Dir, 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.Create(tusDataPath(upload.id))
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err == nil {
+		err = saveTusUpload(r.Context(), upload)
+	}
+	if err != nil {
+		os.Remove(tusDataPath(upload.id))
+		go myLog.doLog(errorType, "tusCreate() err:"+err.Error())
+		http.Error(w, "failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	// 空文件在创建时就已经完成
+	if length == 0 {
+		if !commitTusUpload(w, r, upload) {
+			return
+		}
+	}
+
+	go myLog.doLog(dailyType, "tus create "+upload.id+" for "+name)
+	w.Header().Set("Location", "/tus/"+upload.id)
+	w.Header().Set("Upload-Expires", time.Now().Add(tusExpire()).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// 返回已经上传的大小
+func tusHead(w http.ResponseWriter, r *http.Request, id string) {
+	upload, err := loadTusUpload(r.Context(), id)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// 追加数据，全部收到之后写入源站
+func tusPatch(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	<-tusLocks.mu
+	locked := tusLocks.ids[id]
+	tusLocks.ids[id] = true
+	tusLocks.mu <- true
+	if locked {
+		http.Error(w, "upload is locked by another request", http.StatusLocked)
+		return
+	}
+	defer func() {
+		<-tusLocks.mu
+		delete(tusLocks.ids, id)
+		tusLocks.mu <- true
+	}()
+
+	upload, err := loadTusUpload(r.Context(), id)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	if offset != upload.offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(tusDataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	// 截掉上一次没有记录到状态中的数据
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		tusError(w, err)
+		return
+	}
+
+	// 连接断开时io.Copy返回错误，已经写入的数据仍然保存
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.length-offset))
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+
+	// 请求已经被取消时用新的context保存状态
+	ctx := context.WithoutCancel(r.Context())
+	upload.offset += n
+	err = saveTusUpload(ctx, upload)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	if copyErr != nil {
+		go myLog.doLog(errorType, "tusPatch() "+id+" err:"+copyErr.Error())
+		return
+	}
+
+	if upload.offset == upload.length && !commitTusUpload(w, r, upload) {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset, 10))
+	w.Header().Set("Upload-Expires", time.Now().Add(tusExpire()).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 取消上传
+func tusDelete(w http.ResponseWriter, r *http.Request, id string) {
+	_, err := loadTusUpload(r.Context(), id)
+	if err != nil {
+		tusError(w, err)
+		return
+	}
+	removeTusUpload(r.Context(), id)
+	go myLog.doLog(dailyType, "tus terminate "+id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 把收到的数据写入源站，并让旧的缓存失效
+func commitTusUpload(w http.ResponseWriter, r *http.Request, upload *tusUpload) bool {
+	ns, ok := namespaceByName(upload.ns)
+	if !ok {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return false
+	}
+	lo, ok := ns.origin.(*localOrigin)
+	if !ok {
+		http.Error(w, "origin of this namespace is not writable", http.StatusBadRequest)
+		return false
+	}
+
+	f, err := os.Open(tusDataPath(upload.id))
+	if err != nil {
+		tusError(w, err)
+		return false
+	}
+	target := filepath.Join(lo.writableRoot().path, filepath.FromSlash(upload.file))
+	_, _, err = writeOriginFile(target, f)
+	f.Close()
+	if err != nil {
+		go myLog.doLog(errorType, "commitTusUpload() "+upload.file+" err:"+err.Error())
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
+		return false
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+	removeTusUpload(ctx, upload.id)
+	invalidateOriginFile(ctx, ns, upload.file)
+	go myLog.doLog(dailyType, "tus complete "+upload.id+" -> "+target)
+	return true
+}
+
+// 把上传的状态写入缓存仓库，并延长过期时间
+func saveTusUpload(ctx context.Context, upload *tusUpload) error {
+	key := tusKeyPrefix + upload.id
+	err := store.Available(key)
+	if err != nil {
+		return err
+	}
+	err = store.HSet(ctx, key, map[string]interface{}{
+		"ns":     upload.ns,
+		"file":   upload.file,
+		"length": upload.length,
+		"offset": upload.offset,
+	})
+	if err != nil {
+		return err
+	}
+	return store.Expire(ctx, key, tusExpire())
+}
+
+// 从缓存仓库读取上传的状态，上传不存在或者已经过期时返回os.ErrNotExist
+func loadTusUpload(ctx context.Context, id string) (*tusUpload, error) {
+	key := tusKeyPrefix + id
+	err := store.Available(key)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := store.HGetAll(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if fields["file"] == "" {
+		return nil, os.ErrNotExist
+	}
+	upload := &tusUpload{id: id, ns: fields["ns"], file: fields["file"]}
+	upload.length, _ = strconv.ParseInt(fields["length"], 10, 64)
+	upload.offset, _ = strconv.ParseInt(fields["offset"], 10, 64)
+	return upload, nil
+}
+
+// 删除上传的状态以及没有完成的数据
+func removeTusUpload(ctx context.Context, id string) {
+	err := store.Del(ctx, tusKeyPrefix+id)
+	if err != nil {
+		go myLog.doLog(errorType, "removeTusUpload() err:"+err.Error())
+	}
+	os.Remove(tusDataPath(id))
+}
+
+// 把错误返回给客户端
+func tusError(w http.ResponseWriter, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "upload not found", http.StatusNotFound)
+		return
+	}
+	go myLog.doLog(errorType, "tus err:"+err.Error())
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// 定时删除已经过期的上传的数据
+func cleanTusUploads(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		entries, err := os.ReadDir(setting.Tus.Dir)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				myLog.doLog(errorType, "cleanTusUploads() err:"+err.Error())
+			}
+			continue
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			// 刚创建的上传可能还没有写入状态
+			if err != nil || time.Since(info.ModTime()) < interval {
+				continue
+			}
+			key := tusKeyPrefix + entry.Name()
+			if store.Available(key) != nil {
+				continue
+			}
+			exist, err := store.Exists(context.Background(), key)
+			if err != nil || exist {
+				continue
+			}
+			os.Remove(filepath.Join(setting.Tus.Dir, entry.Name()))
+			myLog.doLog(dailyType, "tus upload "+entry.Name()+" expired")
+		}
+	}
+}
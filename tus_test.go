@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 默认命名空间使用临时目录中的源站，tus的数据也放在临时目录中
+func newTusTest(t *testing.T) (*namespace, string) {
+	t.Helper()
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	ns.name, ns.keyPrefix = "", defaultKeyPrefix
+
+	oldDefault, oldAdminToken, oldTus, oldUpload := defaultNamespace, setting.AdminToken, setting.Tus, setting.Upload
+	t.Cleanup(func() {
+		defaultNamespace, setting.AdminToken, setting.Tus, setting.Upload = oldDefault, oldAdminToken, oldTus, oldUpload
+	})
+	defaultNamespace = ns
+	setting.AdminToken = "secret"
+	setting.Tus.Dir = t.TempDir()
+	setting.Upload.MaxSize = 0
+	setting.Upload.AllowedTypes = nil
+	return ns, dir
+}
+
+// 发送一个tus请求
+func tusRequest(t *testing.T, method string, path string, header map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("X-Admin-Token", "secret")
+	r.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handleTus(w, r)
+	return w
+}
+
+func tusCreateUpload(t *testing.T, name string, length string) string {
+	t.Helper()
+	w := tusRequest(t, http.MethodPost, "/tus/", map[string]string{
+		"Upload-Length":   length,
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+	}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %v %v", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/tus/") {
+		t.Fatalf("Location = %q", location)
+	}
+	return location
+}
+
+func tusPatchRequest(t *testing.T, location string, offset string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return tusRequest(t, http.MethodPatch, location, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": offset,
+	}, body)
+}
+
+func TestTusUpload(t *testing.T) {
+	ns, dir := newTusTest(t)
+	ctx := context.Background()
+
+	// 旧的文件已经在缓存中
+	writeTestFile(t, dir, "old")
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+
+	location := tusCreateUpload(t, "a.txt", "10")
+	if w := tusRequest(t, http.MethodHead, location, nil, ""); w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("head: %v offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	w := tusPatchRequest(t, location, "0", "hello")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("patch: %v offset %q %v", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	// 偏移与已经上传的大小不一致
+	if w = tusPatchRequest(t, location, "3", "lo"); w.Code != http.StatusConflict {
+		t.Fatalf("patch with wrong offset: %v", w.Code)
+	}
+	if w = tusRequest(t, http.MethodHead, location, nil, ""); w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "10" {
+		t.Fatalf("head after patch: offset %q length %q", w.Header().Get("Upload-Offset"), w.Header().Get("Upload-Length"))
+	}
+	// 源站中还是旧的文件
+	if content, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "old" {
+		t.Fatalf("origin file before commit = %q", content)
+	}
+
+	// 数据全部收到之后写入源站，旧的缓存失效
+	if w = tusPatchRequest(t, location, "5", "world"); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("last patch: %v offset %q %v", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "helloworld" {
+		t.Fatalf("origin file after commit = %q", content)
+	}
+	if got := cachedData(t, fr.key); got != "helloworld" {
+		t.Fatalf("cached data after commit = %q", got)
+	}
+	if data, err := getFile(ctx, newFileRequest(ns, "a.txt", nil)); err != nil || string(data) != "helloworld" {
+		t.Fatalf("getFile() after commit = %q, %v", data, err)
+	}
+
+	// 完成的上传不能再访问
+	if w = tusRequest(t, http.MethodHead, location, nil, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("head after commit: %v", w.Code)
+	}
+	if _, err := os.Stat(tusDataPath(strings.TrimPrefix(location, "/tus/"))); !os.IsNotExist(err) {
+		t.Fatalf("upload data after commit: %v", err)
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	_, dir := newTusTest(t)
+
+	location := tusCreateUpload(t, "b.txt", "10")
+	tusPatchRequest(t, location, "0", "hello")
+	if w := tusRequest(t, http.MethodDelete, location, nil, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %v", w.Code)
+	}
+	if w := tusRequest(t, http.MethodHead, location, nil, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("head after delete: %v", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("terminated upload was written to the origin: %v", err)
+	}
+}
+
+func TestTusRejectsInvalidRequests(t *testing.T) {
+	newTusTest(t)
+	location := tusCreateUpload(t, "c.txt", "10")
+
+	r := httptest.NewRequest(http.MethodHead, location, nil)
+	r.Header.Set("X-Admin-Token", "secret")
+	w := httptest.NewRecorder()
+	handleTus(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("without Tus-Resumable: %v", w.Code)
+	}
+
+	w = tusRequest(t, http.MethodPatch, location, map[string]string{"Content-Type": "text/plain", "Upload-Offset": "0"}, "x")
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("patch with wrong Content-Type: %v", w.Code)
+	}
+
+	// 超过Upload-Length的数据不会写入
+	if w = tusPatchRequest(t, location, "0", "0123456789extra"); w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("patch longer than Upload-Length: offset %q", w.Header().Get("Upload-Offset"))
+	}
+
+	w = tusRequest(t, http.MethodPost, "/tus/", map[string]string{
+		"Upload-Length":   "10",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("../escape.txt")),
+	}, "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("create with file name outside the origin: %v", w.Code)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+	此模块实现上传文件的接口，需要管理接口的令牌。
+	PUT或者POST /upload?ns=&file= 把请求体写入命名空间的源站目录(只支持本地文件系统源站)：
+	1. 请求体先写入目标目录中的临时文件，写完并且落盘后再重命名，读取的请求不会读到写了一半的文件
+	2. 文件大小不能超过upload.maxSize，文件的类型(根据后缀在MineType中查找)必须在upload.allowedTypes中
+	3. 写入之后删除这个文件的负缓存和本地磁盘缓存，已经缓存的文件重新加载，下次下载就是新的内容
+	配置了多个目录时写入第一个可用的目录，其他目录的副本需要自己同步
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 检查上传的文件名，不能是绝对路径，也不能跳出源站目录
+func cleanUploadName(name string) (string, bool) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return "", false
+	}
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != name || strings.HasPrefix(clean, ".") {
+		return "", false
+	}
+	return clean, true
+}
+
+// 文件的类型是否允许上传，allowedTypes为空时都允许，支持image/*这样的通配
+func uploadTypeAllowed(name string) bool {
+	if len(setting.Upload.AllowedTypes) == 0 {
+		return true
+	}
+	mimeType, _ := setting.MineType[getFileSuffix(name)].(string)
+	for _, pattern := range setting.Upload.AllowedTypes {
+		if matchMimeType(pattern, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查上传的命名空间、文件名、类型和大小，不通过时返回错误给客户端
+func uploadTarget(w http.ResponseWriter, nsName string, file string, size int64) (*namespace, *localOrigin, string, bool) {
+	ns, ok := namespaceByName(nsName)
+	if !ok {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return nil, nil, "", false
+	}
+	lo, ok := ns.origin.(*localOrigin)
+	if !ok {
+		http.Error(w, "origin of this namespace is not writable", http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	name, ok := cleanUploadName(file + ns.suffix)
+	if !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	if !uploadTypeAllowed(name) {
+		http.Error(w, "file type is not allowed", http.StatusUnsupportedMediaType)
+		return nil, nil, "", false
+	}
+	maxSize := int64(setting.Upload.MaxSize) << 20
+	if maxSize > 0 && size > maxSize {
+		http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+		return nil, nil, "", false
+	}
+	return ns, lo, name, true
+}
+
+// 处理上传文件的请求
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !requireScope(w, r, adminScope) {
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	ns, lo, name, ok := uploadTarget(w, query.Get("ns"), query.Get("file"), r.ContentLength)
+	if !ok {
+		return
+	}
+	maxSize := int64(setting.Upload.MaxSize) << 20
+
+	target := filepath.Join(lo.writableRoot().path, filepath.FromSlash(name))
+	_, statErr := os.Stat(target)
+	created := errors.Is(statErr, os.ErrNotExist)
+
+	body := io.Reader(r.Body)
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxSize)
+	}
+	size, hash, err := writeOriginFile(target, body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "file is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		go myLog.doLog(errorType, "handleUpload() "+name+" err:"+err.Error())
+		http.Error(w, "failed to save file", http.StatusInternalServerError)
+		return
+	}
+
+	// 让旧的缓存失效，已经缓存的文件重新加载
+	invalidateOriginFile(r.Context(), ns, name)
+	go myLog.doLog(dailyType, "upload "+target)
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"namespace": ns.name,
+		"file":      name,
+		"size":      size,
+		"sha256":    hash,
+	})
+}
+
+// 把内容写入源站的文件，先写同一个目录中的临时文件，落盘之后再重命名
+func writeOriginFile(target string, body io.Reader) (int64, string, error) {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return 0, "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".upload-*")
+	if err != nil {
+		return 0, "", err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,203 @@
+/*
+	此模块负责发现源站(本地文件系统)中文件的变化。
+	缓存文件时会一起保存文件的修改时间(mtime)、大小(size)和内容的sha256(hash)，
+	源站中的文件被覆盖或者删除之后，有两种方式让缓存失效：
+	1. watchOrigin为true时用inotify监听源站目录(只支持linux)，文件变化时立即重新加载，删除时清除缓存
+	2. 每隔revalidateInterval秒遍历一次缓存中的文件，与源站文件的mtime和size比较，
+	   用于NFS这样inotify收不到其他机器修改的文件系统。mtime变了但是大小没变时再比较hash，
+	   只是touch过的文件不需要重新加载。只在本地磁盘缓存中的文件同样与源站比较，变化时删除
+	文件出现或者变化时也会删除它的负缓存以及本地磁盘缓存
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 返回与文件一起保存在缓存中的版本信息
+func versionFields(fr *fileRequest, data []byte) map[string]interface{} {
+	var mtime int64
+	if !fr.lastModified.IsZero() {
+		mtime = fr.lastModified.UnixNano()
+	}
+	return map[string]interface{}{
+		"mtime": mtime,
+		"size":  len(data),
+		"hash":  contentHash(data),
+	}
+}
+
+// 返回文件内容的sha256
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 根据缓存key找到文件所在的命名空间以及文件名，keyPrefix最长的命名空间优先
+func namespaceForKey(key string) (*namespace, string) {
+	name := strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}")
+	found := defaultNamespace
+	for _, ns := range namespaces {
+		if strings.HasPrefix(name, ns.keyPrefix) && len(ns.keyPrefix) > len(found.keyPrefix) {
+			found = ns
+		}
+	}
+	return found, strings.TrimPrefix(name, found.keyPrefix)
+}
+
+// 源站中的文件发生了变化，已经缓存的文件重新加载，源站删除的文件由revalidate清除缓存
+func invalidateOriginFile(ctx context.Context, ns *namespace, name string) {
+	key := fileKey(ns.keyPrefix + name)
+	negative.forget(ctx, key)
+	if diskCache != nil {
+		diskCache.remove(key)
+	}
+
+	if store.Available(key) != nil {
+		return
+	}
+	_, err := store.HGet(ctx, key, "size")
+	if err == errCacheMiss {
+		// 只有访问次数或者没有缓存的文件，下次请求时自然会读到新的文件
+		return
+	}
+	if err != nil {
+		go myLog.doLog(errorType, "invalidateOriginFile() err:"+err.Error())
+		return
+	}
+	reloadChangedFile(newFileRequest(ns, name, nil))
+}
+
+// 定时与源站的文件比较，重新加载发生变化的文件
+func revalidateSweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		checked, changed := sweepOrigin(context.Background())
+		myLog.doLog(dailyType, fmt.Sprintf("origin revalidation: checked %v files, %v changed", checked, changed))
+	}
+}
+
+// 遍历一次缓存以及本地磁盘缓存中的文件，返回检查的文件数以及发生变化的文件数
+func sweepOrigin(ctx context.Context) (checked int, changed int) {
+	seen := make(map[string]bool)
+	err := store.Scan(ctx, func(key string) {
+		ns, name := namespaceForKey(key)
+		lo, ok := ns.origin.(*localOrigin)
+		if !ok {
+			return
+		}
+		fileChanged, cached := originChanged(ctx, lo, key, name)
+		if !cached {
+			// 只有访问次数的key，文件可能在本地磁盘缓存中，下面再比较
+			return
+		}
+		checked++
+		seen[key] = true
+		if fileChanged {
+			changed++
+			invalidateOriginFile(ctx, ns, name)
+		}
+	})
+	if err != nil {
+		myLog.doLog(errorType, "sweepOrigin() err:"+err.Error())
+	}
+
+	// 只在本地磁盘缓存中的文件
+	if diskCache != nil {
+		for _, entry := range diskCache.entries() {
+			if seen[entry.meta.Key] {
+				continue
+			}
+			ns, name := namespaceForKey(entry.meta.Key)
+			lo, ok := ns.origin.(*localOrigin)
+			if !ok {
+				continue
+			}
+			checked++
+			if tierChanged(lo, entry, name) {
+				changed++
+				invalidateOriginFile(ctx, ns, name)
+			}
+		}
+	}
+	return checked, changed
+}
+
+// 比较缓存中的版本信息与源站的文件，判断文件是否发生了变化，cached为key中是否缓存了文件内容
+func originChanged(ctx context.Context, lo *localOrigin, key string, name string) (changed bool, cached bool) {
+	size, err := store.HGet(ctx, key, "size")
+	if err != nil {
+		// 没有缓存文件内容的key
+		return false, false
+	}
+	mtime, _ := store.HGet(ctx, key, "mtime")
+
+	info, err := lo.stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, true
+	}
+	if err != nil {
+		return false, true
+	}
+	if strconv.FormatInt(info.Size(), 10) != size {
+		return true, true
+	}
+	if strconv.FormatInt(info.ModTime().UnixNano(), 10) == mtime {
+		return false, true
+	}
+
+	// 大小没变但是mtime变了，比较内容的hash
+	obj, err := lo.Fetch(ctx, name, nil, validators{})
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist), true
+	}
+	hash, _ := store.HGet(ctx, key, "hash")
+	if contentHash(obj.Data) != hash {
+		return true, true
+	}
+	// 内容没有变化，记录新的mtime，下次不用再比较hash
+	err = store.HSet(ctx, key, map[string]interface{}{"mtime": obj.LastModified.UnixNano()})
+	if err != nil {
+		go myLog.doLog(errorType, "originChanged() err:"+err.Error())
+	}
+	return false, true
+}
+
+// 比较本地磁盘缓存中的文件与源站的文件，没有记录修改时间的文件只比较大小
+func tierChanged(lo *localOrigin, entry tierEntry, name string) bool {
+	info, err := lo.stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	if info.Size() != entry.size {
+		return true
+	}
+	return entry.meta.LastModified != 0 && info.ModTime().UnixNano() != entry.meta.LastModified
+}
+
+// 返回每个源站目录以及使用它的命名空间
+func watchedRoots() map[string][]*namespace {
+	roots := make(map[string][]*namespace)
+	for _, ns := range allNamespaces() {
+		lo, ok := ns.origin.(*localOrigin)
+		if !ok {
+			continue
+		}
+		for _, root := range lo.roots {
+			roots[root.path] = append(roots[root.path], ns)
+		}
+	}
+	return roots
+}
@@ -0,0 +1,139 @@
+//go:build linux
+
+/*
+	此模块使用inotify监听源站目录，目录中的子目录也会被监听，新建的子目录会自动加入。
+	文件写完(IN_CLOSE_WRITE)、移入(IN_MOVED_TO)、删除(IN_DELETE)或者移出(IN_MOVED_FROM)时
+	让这个文件的缓存失效。事件太多导致队列溢出时只记录日志，由定时的比较兜底
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	watchDirMask  = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+	watchFileMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+)
+
+// 一个被监听的目录
+type watchedDir struct {
+	root string // 源站目录
+	rel  string // 相对于源站目录的路径，源站目录本身为空
+}
+
+// 源站目录的监听器
+type originWatcher struct {
+	fd    int
+	roots map[string][]*namespace
+	dirs  map[int32]watchedDir // inotify的watch descriptor到目录的映射
+}
+
+// 监听源站目录中文件的变化
+func watchOrigin() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	ow := &originWatcher{fd: fd, roots: watchedRoots(), dirs: make(map[int32]watchedDir)}
+	for root := range ow.roots {
+		err = ow.addTree(root, "")
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+	}
+
+	go ow.run()
+	return nil
+}
+
+// 监听目录以及它下面所有的子目录
+func (ow *originWatcher) addTree(root string, rel string) error {
+	return filepath.WalkDir(filepath.Join(root, rel), func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(ow.fd, p, watchDirMask|watchFileMask)
+		if err != nil {
+			return err
+		}
+		sub, _ := filepath.Rel(root, p)
+		if sub == "." {
+			sub = ""
+		}
+		ow.dirs[int32(wd)] = watchedDir{root: root, rel: filepath.ToSlash(sub)}
+		return nil
+	})
+}
+
+// 读取inotify事件
+func (ow *originWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(ow.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			myLog.doLog(errorType, "originWatcher.run() err:"+err.Error())
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			ow.handle(event, name)
+		}
+	}
+}
+
+// 处理一个inotify事件
+func (ow *originWatcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		myLog.doLog(errorType, "originWatcher: inotify queue overflow, some changes are left to revalidation")
+		return
+	}
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		// 目录被删除，内核已经去掉了监听
+		delete(ow.dirs, event.Wd)
+		return
+	}
+	dir, ok := ow.dirs[event.Wd]
+	if !ok || name == "" {
+		return
+	}
+	rel := path.Join(dir.rel, name)
+
+	if event.Mask&syscall.IN_ISDIR != 0 {
+		// 新建或者移入的子目录也要监听
+		if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			err := ow.addTree(dir.root, rel)
+			if err != nil {
+				myLog.doLog(errorType, "originWatcher.addTree() err:"+err.Error())
+			}
+		}
+		return
+	}
+	if event.Mask&watchFileMask == 0 {
+		return
+	}
+
+	for _, ns := range ow.roots[dir.root] {
+		go invalidateOriginFile(context.Background(), ns, rel)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+/*
+	inotify只在linux上可用，其他系统只能依靠定时的比较发现源站的文件变化
+*/
+
+package main
+
+import "errors"
+
+// 监听源站目录中文件的变化
+func watchOrigin() error {
+	return errors.New("watching origin directories is only supported on linux")
+}
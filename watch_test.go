@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 把命名空间加入全局的命名空间，namespaceForKey才能根据key找到它
+func registerTestNamespace(t *testing.T, ns *namespace) {
+	t.Helper()
+	old := namespaces
+	t.Cleanup(func() { namespaces = old })
+	namespaces = map[string]*namespace{ns.name: ns}
+}
+
+func writeTestFile(t *testing.T, dir string, content string) {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cachedData(t *testing.T, key string) string {
+	t.Helper()
+	data, _ := store.HGet(context.Background(), key, "data")
+	return data
+}
+
+// 缓存中只有访问次数、文件在本地磁盘缓存中时，源站的文件变化后要从本地磁盘缓存中删除
+func TestSweepOriginDiskTierOnly(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 2, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	registerTestNamespace(t, ns)
+	diskCache = newTestDiskTier(t, t.TempDir(), 1<<20, 1)
+	ctx := context.Background()
+
+	writeTestFile(t, dir, "v1")
+	fr := newFileRequest(ns, "a.txt", nil)
+	obj, err := ns.origin.Fetch(ctx, fr.name, nil, validators{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr.lastModified = obj.LastModified
+	diskCache.put(fr.key, obj.Data, metaFromRequest(fr), diskCache.generation())
+	if err = loadAccessToRedis(ctx, fr, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if checked, changed := sweepOrigin(ctx); checked != 1 || changed != 0 {
+		t.Fatalf("unchanged file: checked %v, changed %v", checked, changed)
+	}
+	if _, _, ok := diskCache.get(fr.key); !ok {
+		t.Fatal("unchanged file was removed from the disk tier")
+	}
+
+	writeTestFile(t, dir, "v2 longer")
+	if _, changed := sweepOrigin(ctx); changed != 1 {
+		t.Fatalf("changed = %v, want 1", changed)
+	}
+	if _, _, ok := diskCache.get(fr.key); ok {
+		t.Fatal("changed file is still in the disk tier")
+	}
+
+	// 访问次数达到loadCount+1时写入缓存的是新的文件
+	for i := 0; i < 2; i++ {
+		data, err := getFile(ctx, newFileRequest(ns, "a.txt", nil))
+		if err != nil || string(data) != "v2 longer" {
+			t.Fatalf("getFile() = %q, %v", data, err)
+		}
+	}
+	if got := cachedData(t, fr.key); got != "v2 longer" {
+		t.Fatalf("cached data = %q", got)
+	}
+}
+
+func TestSweepOriginCachedFile(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	registerTestNamespace(t, ns)
+	ctx := context.Background()
+
+	writeTestFile(t, dir, "v1")
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+	if checked, changed := sweepOrigin(ctx); checked != 1 || changed != 0 {
+		t.Fatalf("unchanged file: checked %v, changed %v", checked, changed)
+	}
+
+	writeTestFile(t, dir, "v2 longer")
+	if _, changed := sweepOrigin(ctx); changed != 1 {
+		t.Fatalf("changed = %v, want 1", changed)
+	}
+	if got := cachedData(t, fr.key); got != "v2 longer" {
+		t.Fatalf("cached data = %q, want the new file", got)
+	}
+
+	// 源站删除的文件从缓存中清除
+	os.Remove(filepath.Join(dir, "a.txt"))
+	sweepOrigin(ctx)
+	if exist, _ := store.Exists(ctx, fr.key); exist {
+		t.Fatal("deleted file is still cached")
+	}
+}
+
+// 文件变化时正在进行的重新加载读到的是旧文件，结束之后要再加载一次
+func TestReloadChangedFileWaitsForInflight(t *testing.T) {
+	ns, dir := newTestNamespace(t, cachePolicy{LoadCount: 0, ExtendCount: 10, TTL: time.Minute, HotTTL: time.Hour})
+	ctx := context.Background()
+
+	writeTestFile(t, dir, "v1")
+	fr := newFileRequest(ns, "a.txt", nil)
+	if _, err := getFile(ctx, fr); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟一个在文件变化之前开始的重新加载
+	done, ok := startRevalidate(fr.key)
+	if !ok {
+		t.Fatal("startRevalidate() = false")
+	}
+	writeTestFile(t, dir, "v2")
+
+	reloaded := make(chan struct{})
+	go func() {
+		invalidateOriginFile(ctx, ns, "a.txt")
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+		t.Fatal("invalidateOriginFile() returned while a reload was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 正在进行的重新加载把旧文件写回缓存之后结束
+	if err := loadFileToRedis(ctx, fr, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	finishRevalidate(fr.key, done)
+	<-reloaded
+
+	if got := cachedData(t, fr.key); got != "v2" {
+		t.Fatalf("cached data = %q, want v2", got)
+	}
+}